@@ -5,41 +5,65 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"time"
 
 	"github.com/clobrano/TaskwarriorAgenda/pkg/auth" // Adjust import path
 	"github.com/spf13/cobra"
+	"golang.org/x/oauth2"
 )
 
 var authCmd = &cobra.Command{
 	Use:   "auth",
-	Short: "Remove existing Token file and re-authenticate with Google Calendar API",
+	Short: "Authorize access to Google Calendar, replacing the stored token",
 	Long: `Authenticates with your Google account to access Google Calendar.
 This command will guide you through the OAuth 2.0 process to get the necessary
-tokens for API access.`,
+tokens for API access. The token replaces the one in the configured token
+store (auth.token_store: file, encrypted or keyring).
+
+With a service account (auth.service_account in config.yaml) there is nothing
+to authorize: the key is checked instead.
+
+On machines without a browser, e.g. over SSH, use --flow device to enter a code
+on another device, or --flow manual to open the authorization page on another
+machine and paste the address the browser is redirected to. Google allows the
+device flow only for a few scopes, not the Calendar ones: it falls back to the
+manual flow when the code is refused.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := context.Background()
 
-		// Delete existing token file
-		xdgConfigBase, err := auth.GetXdgHome()
-		if err != nil {
-			log.Fatalf("could not find path to configuration file: error %v", err)
+		options := authOptions()
+		if cmd.Flags().Changed("flow") {
+			options.Flow, _ = cmd.Flags().GetString("flow")
+		}
+		if cmd.Flags().Changed("listen") {
+			options.ListenAddress, _ = cmd.Flags().GetString("listen")
+		}
+		if err := auth.Configure(options); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		if auth.UsesServiceAccount() {
+			// Nothing to authorize: check that the key works
+			email, err := auth.CheckServiceAccount(ctx)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			log.Printf("Authenticating as the service account %s set in config.yaml: no authorization needed.", email)
 			return
 		}
 
-		tokenFile := filepath.Join(xdgConfigBase, auth.TokenFile)
-		_, err = os.Stat(tokenFile)
+		// Delete the existing token
+		store, err := auth.TokenStoreInUse()
 		if err != nil {
-			if !os.IsNotExist(err) {
-				log.Fatalf("could not find token file '%s', error %v. Please delete it manually", tokenFile, err)
-			}
-		} else {
-			log.Printf("Removing existing token file at '%s'\n", tokenFile)
-			if err = os.Remove(tokenFile); err != nil {
-				log.Fatalf("could not delete token file '%s', error %v. Please delete it manually", tokenFile, err)
-			}
+			log.Fatalf("Error: %v", err)
+		}
+		log.Printf("Removing existing token from %s\n", store)
+		if err := store.Delete(); err != nil {
+			log.Fatalf("could not delete token from %s, error %v. Please delete it manually", store, err)
 		}
 
 		// GetCalendarService will handle the full OAuth flow if needed,
@@ -48,11 +72,132 @@ tokens for API access.`,
 		if err != nil {
 			log.Fatalf("Authentication failed: %v", err)
 		}
-		log.Printf("Authentication successful! Token saved to %s", auth.TokenFile)
+		log.Printf("Authentication successful! Token saved to %s", store)
 		log.Println("You can now run 'TaskwarriorAgenda sync' to synchronize your tasks.")
 	},
 }
 
+// authMigrateCmd represents the auth migrate command
+var authMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Move the token to the store set in config.yaml",
+	Long: `Move the token from another store (by default the plain token.json file) to
+the one set with auth.token_store in config.yaml, and delete it from the old
+one.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		from, _ := cmd.Flags().GetString("from")
+		fromPath, _ := cmd.Flags().GetString("from-path")
+
+		options := authOptions()
+		to := options.Token.Backend
+		if to == "" {
+			to = auth.StoreFile
+		}
+		if from == to && fromPath == "" {
+			log.Fatalf("Error: the token is already stored with '%s'. Set auth.token_store in config.yaml to the store to migrate to", from)
+		}
+		source := options.Token
+		source.Backend = from
+		source.Path = fromPath
+		src, err := auth.NewTokenStore(source)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		dst, err := auth.TokenStoreInUse()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		tok, err := src.Load()
+		if err != nil {
+			log.Fatalf("Error: unable to load token from %s: %v", src, err)
+		}
+		if err := dst.Save(tok); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		// Read it back before deleting the only other copy
+		if _, err := dst.Load(); err != nil {
+			log.Fatalf("Error: unable to read the migrated token back from %s: %v", dst, err)
+		}
+		if err := src.Delete(); err != nil {
+			log.Fatalf("Error: token copied to %s, but not deleted from %s: %v", dst, src, err)
+		}
+		fmt.Printf("Token moved from %s to %s\n", src, dst)
+	},
+}
+
+// authStatusCmd represents the auth status command
+var authStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the Google account, the granted scopes and whether the token can be refreshed",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := auth.GetStatus(context.Background())
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		if status.ServiceAccount != "" {
+			fmt.Printf("Service account: %s\n", status.ServiceAccount)
+		}
+		if status.Account != "" {
+			fmt.Printf("Account:         %s\n", status.Account)
+		}
+		if status.Store != "" {
+			fmt.Printf("Token stored in: %s\n", status.Store)
+			fmt.Printf("Refresh token:   %t\n", status.RefreshToken)
+		}
+		if !status.Expiry.IsZero() {
+			fmt.Printf("Access token:    expires %s\n", status.Expiry.Local().Format(time.RFC1123))
+		}
+
+		if status.RefreshErr != nil {
+			fmt.Printf("Refresh:         failed: %v\n", status.RefreshErr)
+			var retrieveErr *oauth2.RetrieveError
+			if errors.As(status.RefreshErr, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+				fmt.Println("The authorization was revoked or has expired (it lasts 7 days for apps in testing): run 'auth' again.")
+			}
+			os.Exit(1)
+		}
+		fmt.Println("Refresh:         ok")
+
+		if len(status.Scopes) > 0 {
+			fmt.Println("Scopes:")
+			granted := make(map[string]bool)
+			for _, scope := range status.Scopes {
+				fmt.Printf("  %s\n", scope)
+				granted[scope] = true
+			}
+			for _, scope := range auth.Scopes {
+				if !granted[scope] {
+					fmt.Printf("Missing scope %s: run 'auth' again and grant all the permissions\n", scope)
+				}
+			}
+		}
+	},
+}
+
+// authRevokeCmd represents the auth revoke command
+var authRevokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke the access given to TaskwarriorAgenda and delete the token",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := auth.Revoke(context.Background()); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		fmt.Println("Access revoked and token deleted. Run 'auth' to authorize again.")
+	},
+}
+
 func init() {
 	rootCmd.AddCommand(authCmd)
+	authCmd.AddCommand(authMigrateCmd)
+	authCmd.AddCommand(authStatusCmd)
+	authCmd.AddCommand(authRevokeCmd)
+	authMigrateCmd.Flags().String("from", auth.StoreFile, fmt.Sprintf("Store to move the token from (%s, %s or %s)", auth.StoreFile, auth.StoreEncrypted, auth.StoreKeyring))
+	authMigrateCmd.Flags().String("from-path", "", "File of the store to move the token from, if not the default one")
+	authCmd.Flags().String("flow", auth.FlowBrowser, fmt.Sprintf("Authorization flow (%s, %s or %s)", auth.FlowBrowser, auth.FlowManual, auth.FlowDevice))
+	authCmd.Flags().String("listen", auth.DefaultListenAddress, "Address the browser flow listens on for the redirect (port 0 picks a free one)")
 }
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/clobrano/TaskwarriorAgenda/internal/fsutil"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/ical"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/source"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd groups the export formats
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export tasks to a file",
+}
+
+// exportICSCmd represents the export ics command
+var exportICSCmd = &cobra.Command{
+	Use:   "ics",
+	Short: "Export tasks as an iCalendar (.ics) file",
+	Long: `Export the tasks selected the same way as the sync command to an iCalendar
+file, that any calendar application can import or subscribe to.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		sourceName, _ := cmd.Flags().GetString("source")
+		filter, _ := cmd.Flags().GetString("filter")
+		kind, _ := cmd.Flags().GetString("type")
+		output, _ := cmd.Flags().GetString("output")
+		if kind != ical.KindEvent && kind != ical.KindTodo && kind != ical.KindBoth {
+			log.Fatalf("Error: invalid type '%s'. Please use 'event', 'todo' or 'both'", kind)
+		}
+
+		_, tasks, err := fetchTasks(profile{Source: sourceName, Filter: filter}, false)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		var data bytes.Buffer
+		if err := ical.Encode(&data, ical.TasksToCalendar(tasks, kind)); err != nil {
+			log.Fatalf("Error encoding the calendar: %v", err)
+		}
+
+		if output == "-" {
+			os.Stdout.Write(data.Bytes())
+			return
+		}
+		// Feeds are meant to be shared
+		if err := fsutil.WriteFileAtomic(output, data.Bytes(), 0644); err != nil {
+			log.Fatalf("Error writing %s: %v", output, err)
+		}
+		log.Printf("Exported %d tasks to %s", len(tasks), output)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.AddCommand(exportICSCmd)
+	exportICSCmd.Flags().String("source", "", fmt.Sprintf("Source of tasks (%s)", strings.Join(source.Names(), ", ")))
+	exportICSCmd.MarkFlagRequired("source")
+	exportICSCmd.Flags().String("filter", "", "Filter to apply to the tasks")
+	exportICSCmd.Flags().String("type", ical.KindEvent, "Export tasks as 'event', 'todo' or 'both'")
+	exportICSCmd.Flags().StringP("output", "o", "-", "File to write, or - for the standard output")
+}
@@ -0,0 +1,358 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/auth"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/hook"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/source"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/state"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/taskwarrior"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// hookQueueDir is the directory, next to state.json, of the tasks
+	// queued by the hooks.
+	hookQueueDir = "hook-queue"
+	// hookLogFile is the file the syncs started by the hooks log to.
+	hookLogFile = "hook.log"
+)
+
+// hookCmd groups the Taskwarrior hook commands
+var hookCmd = &cobra.Command{
+	Use:   "hook",
+	Short: "Sync Taskwarrior tasks as soon as they change, from Taskwarrior hooks",
+	Long: `Taskwarrior runs the on-add and on-modify hooks every time a task is added or
+changed. The hooks queue the task and start a sync in the background, so that
+the change appears in the calendar within seconds without slowing Taskwarrior
+down. Run "hook install" to install them.`,
+}
+
+// hookInstallCmd represents the hook install command
+var hookInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install the on-add and on-modify hooks in Taskwarrior",
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, err := hookProfiles(defaultCalendar, ""); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		dir, err := taskwarrior.NewClient().HooksLocation()
+		if err != nil {
+			log.Fatalf("Error finding the Taskwarrior hooks directory: %v", err)
+		}
+		executable, err := os.Executable()
+		if err != nil {
+			log.Fatalf("Error finding the path of this program: %v", err)
+		}
+		paths, err := hook.Install(dir, executable)
+		if err != nil {
+			log.Fatalf("Error installing the hooks: %v", err)
+		}
+		for _, path := range paths {
+			fmt.Printf("Installed %s\n", path)
+		}
+	},
+}
+
+// hookFlushCmd represents the hook flush command
+var hookFlushCmd = &cobra.Command{
+	Use:   "flush",
+	Short: "Sync the tasks queued by the hooks",
+	Long: `Sync the tasks queued by the hooks. It is started by the hooks themselves, and
+waits for any other flush in progress to finish first.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		calendar, _ := cmd.Flags().GetString("calendar")
+		filter, _ := cmd.Flags().GetString("filter")
+		delay, _ := cmd.Flags().GetDuration("delay")
+		if !cmd.Flags().Changed("calendar") && viper.IsSet("hook.calendar") {
+			calendar = viper.GetString("hook.calendar")
+		}
+		if !cmd.Flags().Changed("filter") && viper.IsSet("hook.filter") {
+			filter = viper.GetString("hook.filter")
+		}
+		if !cmd.Flags().Changed("delay") && viper.IsSet("hook.delay") {
+			delay = viper.GetDuration("hook.delay")
+		}
+
+		queue, err := hookQueue()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		unlock, err := queue.Lock()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer unlock()
+
+		// The hooks run before Taskwarrior saves the task: give it time to
+		// finish, and to the changes made in a row to be queued together
+		time.Sleep(delay)
+		flushHookQueue(queue, calendar, filter)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(hookCmd)
+	hookCmd.AddCommand(hookInstallCmd)
+	hookCmd.AddCommand(hookFlushCmd)
+	hookFlushCmd.Flags().String("calendar", defaultCalendar, "Google Calendar name or ID to sync with (or hook.calendar in config.yaml)")
+	hookFlushCmd.Flags().String("filter", "", "Filter the queued tasks must match to be synced (or hook.filter in config.yaml)")
+	hookFlushCmd.Flags().Duration("delay", 2*time.Second, "How long to wait before reading the queued tasks (or hook.delay in config.yaml)")
+
+	for _, event := range []string{hook.OnAdd, hook.OnModify} {
+		hookCmd.AddCommand(&cobra.Command{
+			Use:   event,
+			Short: fmt.Sprintf("Run as the Taskwarrior %s hook", event),
+			Args:  cobra.NoArgs,
+			Run: func(cmd *cobra.Command, args []string) {
+				runHook(event)
+			},
+		})
+	}
+}
+
+// IsHookEvent tells whether args run a Taskwarrior hook event. The hook
+// events must pass the task through and exit successfully whatever happens,
+// as Taskwarrior rejects the change otherwise.
+func IsHookEvent(args []string) bool {
+	return len(args) == 2 && args[0] == hookCmd.Name() && (args[1] == hook.OnAdd || args[1] == hook.OnModify)
+}
+
+// HookLogf appends a message to the hook log file, where the errors of the
+// hooks can be found later.
+func HookLogf(format string, args ...any) {
+	xdgConfigBase, err := auth.GetXdgHome()
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(xdgConfigBase, 0700); err != nil {
+		return
+	}
+	logFile, err := os.OpenFile(filepath.Join(xdgConfigBase, hookLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	defer logFile.Close()
+	log.New(logFile, "", log.LstdFlags).Printf(format, args...)
+}
+
+// hookError reports an error of a hook as Taskwarrior feedback, and in the
+// hook log.
+func hookError(format string, args ...any) {
+	fmt.Printf("TaskwarriorAgenda: "+format+"\n", args...)
+	HookLogf(format, args...)
+}
+
+// runHook passes the task Taskwarrior is saving through unchanged, queues it
+// and starts a flush in the background. Errors are reported as Taskwarrior
+// feedback, without rejecting the change.
+func runHook(event string) {
+	defer func() {
+		if r := recover(); r != nil {
+			hookError("%s hook failed: %v", event, r)
+		}
+	}()
+
+	line, task, err := hook.Read(os.Stdin, event)
+	// Taskwarrior expects the task back as the first line of the output
+	if line != nil {
+		os.Stdout.Write(line)
+		fmt.Println()
+	}
+	if err != nil {
+		hookError("%v", err)
+		return
+	}
+
+	queue, err := hookQueue()
+	if err != nil {
+		hookError("%v", err)
+		return
+	}
+	// Occurrences of recurring tasks are synced as part of their template
+	ids := []string{task.UUID}
+	if task.Parent != "" {
+		ids = append(ids, task.Parent)
+	}
+	for _, id := range ids {
+		if err := queue.Add(id); err != nil {
+			hookError("%v", err)
+			return
+		}
+	}
+
+	if err := startHookFlush(); err != nil {
+		hookError("unable to start the calendar sync: %v", err)
+	}
+}
+
+// startHookFlush runs "hook flush" in the background, logging to the hook
+// log file.
+func startHookFlush() error {
+	xdgConfigBase, err := auth.GetXdgHome()
+	if err != nil {
+		return fmt.Errorf("could not find path to configuration directory: %w", err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(filepath.Join(xdgConfigBase, hookLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open hook log: %w", err)
+	}
+	defer logFile.Close()
+
+	// Taskwarrior waits for the output of the hook to be closed: the flush
+	// must not inherit it
+	flush := exec.Command(executable, "hook", "flush")
+	flush.Stdout = logFile
+	flush.Stderr = logFile
+	hook.Detach(flush)
+	if err := flush.Start(); err != nil {
+		return err
+	}
+	return flush.Process.Release()
+}
+
+// flushHookQueue syncs the queued tasks until the queue is empty, each one
+// with the settings of the profile selecting it. The tasks selected by no
+// profile are left alone.
+func flushHookQueue(queue *hook.Queue, calendar, filter string) {
+	profiles, err := hookProfiles(calendar, filter)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return
+	}
+
+	var store *state.Store
+	clients := &calendarClients{}
+	jobs := make([]*syncJob, len(profiles))
+	for {
+		ids, err := queue.Take()
+		if err != nil {
+			log.Printf("Error: %v", err)
+		}
+		if len(ids) == 0 {
+			return
+		}
+		log.Printf("Syncing %d queued tasks", len(ids))
+
+		runs, err := hookRuns(profiles)
+		if err == nil && store == nil {
+			store, err = loadStore()
+		}
+		for i, run := range runs {
+			if err == nil && jobs[i] == nil {
+				jobs[i], err = newHookSyncJob(run.profile, clients, store)
+			}
+			run.job = jobs[i]
+		}
+		if err != nil {
+			log.Printf("Error: %v", err)
+			// Keep the tasks for the next flush
+			for _, id := range ids {
+				if err := queue.Add(id); err != nil {
+					log.Printf("Error: %v", err)
+				}
+			}
+			return
+		}
+
+		queued := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			queued[id] = true
+		}
+		synced := 0
+		for _, run := range runs {
+			var changed []model.Task
+			for _, task := range run.tasks {
+				if queued[task.ID] {
+					changed = append(changed, task)
+				}
+			}
+			if len(changed) == 0 {
+				continue
+			}
+			if run.profile.Name != "" {
+				log.Printf("Syncing %d queued tasks of profile %s", len(changed), run.profile.Name)
+			}
+			synced += len(changed)
+			run.job.run(run.tasks, changed)
+		}
+		if synced < len(ids) {
+			log.Printf("%d queued tasks are not selected by the filter of any profile", len(ids)-synced)
+		}
+	}
+}
+
+// hookProfiles returns the profiles the queued tasks are synced with: the
+// Taskwarrior profiles of the configuration file, if any, or the one made of
+// the hook calendar and filter.
+func hookProfiles(calendar, filter string) ([]profile, error) {
+	if !viper.IsSet("profiles") {
+		return []profile{{Source: source.Taskwarrior, Filter: filter, Calendar: calendar}}, nil
+	}
+	if viper.IsSet("hook.calendar") || viper.IsSet("hook.filter") {
+		log.Printf("Ignoring hook.calendar and hook.filter: the queued tasks are synced with the profiles selecting them")
+	}
+
+	profiles, err := loadProfiles()
+	if err != nil {
+		return nil, err
+	}
+	var selected []profile
+	for _, p := range profiles {
+		if p.Source == source.Taskwarrior {
+			selected = append(selected, p)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no profile syncs Taskwarrior tasks, the queued tasks cannot be synced")
+	}
+	return selected, nil
+}
+
+// hookRuns reads the tasks of the profiles. As for sync --all-profiles, a
+// task must not be selected by more than one profile.
+func hookRuns(profiles []profile) ([]*profileSync, error) {
+	runs := make([]*profileSync, len(profiles))
+	for i, p := range profiles {
+		_, tasks, err := fetchTasks(p, false)
+		if err != nil {
+			return nil, err
+		}
+		runs[i] = &profileSync{profile: p, tasks: tasks}
+	}
+	if err := checkOverlap(runs); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// newHookSyncJob creates the job syncing the queued tasks of the profile to
+// its calendars. Without the other tasks, nothing can be pruned.
+func newHookSyncJob(p profile, clients *calendarClients, store *state.Store) (*syncJob, error) {
+	routes, err := p.routes()
+	if err != nil {
+		return nil, err
+	}
+	return newSyncJob(clients, store, p.Calendar, routes)
+}
+
+// hookQueue returns the queue of the tasks changed by the hooks.
+func hookQueue() (*hook.Queue, error) {
+	xdgConfigBase, err := auth.GetXdgHome()
+	if err != nil {
+		return nil, fmt.Errorf("could not find path to configuration directory: %w", err)
+	}
+	return hook.NewQueue(filepath.Join(xdgConfigBase, hookQueueDir)), nil
+}
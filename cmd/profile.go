@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+	"github.com/spf13/viper"
+)
+
+// defaultCalendar is the calendar tasks are synced to when none is given.
+const defaultCalendar = "Tasks"
+
+// profile is a set of sync settings: which tasks to sync, and where. Named
+// profiles are read from the "profiles" section of the configuration file,
+// the command line flags make an unnamed one.
+type profile struct {
+	Name     string `mapstructure:"-"`
+	Source   string `mapstructure:"source"`
+	Filter   string `mapstructure:"filter"`
+	Calendar string `mapstructure:"calendar"`
+	// Timing, when set, replaces the timing rules of the configuration file.
+	Timing *util.TimingRules `mapstructure:"timing"`
+	// Routes, when set, replace the routes of the configuration file.
+	Routes []util.Route `mapstructure:"routes"`
+	// Color is the ID of the color of the events, see backend.ColorID.
+	Color string `mapstructure:"color"`
+}
+
+// loadProfile returns the profile with the given name from the configuration
+// file.
+func loadProfile(name string) (profile, error) {
+	key := "profiles." + name
+	if !viper.IsSet(key) {
+		return profile{}, fmt.Errorf("profile '%s' not found in the configuration file", name)
+	}
+
+	var p profile
+	if err := viper.UnmarshalKey(key, &p); err != nil {
+		return profile{}, fmt.Errorf("unable to read profile '%s': %w", name, err)
+	}
+	p.Name = name
+	if p.Source == "" {
+		return profile{}, fmt.Errorf("profile '%s' has no source", name)
+	}
+	if p.Calendar == "" {
+		p.Calendar = defaultCalendar
+	}
+	if p.Color != "" {
+		color, err := backend.ColorID(p.Color)
+		if err != nil {
+			return profile{}, fmt.Errorf("invalid color of profile '%s': %w", name, err)
+		}
+		p.Color = color
+	}
+	if _, err := p.timing(); err != nil {
+		return profile{}, fmt.Errorf("invalid timing of profile '%s': %w", name, err)
+	}
+	return p, nil
+}
+
+// loadProfiles returns all the profiles of the configuration file, sorted by
+// name.
+func loadProfiles() ([]profile, error) {
+	var names []string
+	for name := range viper.GetStringMap("profiles") {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no profiles in the configuration file")
+	}
+	sort.Strings(names)
+
+	profiles := make([]profile, 0, len(names))
+	for _, name := range names {
+		p, err := loadProfile(name)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// timing returns the timing rules of the profile, or the ones of the
+// configuration file if the profile has none.
+func (p profile) timing() (util.TimingRules, error) {
+	var timing util.TimingRules
+	if p.Timing != nil {
+		timing = *p.Timing
+	} else if err := viper.UnmarshalKey("timing", &timing); err != nil {
+		return timing, fmt.Errorf("unable to read timing rules from the configuration file: %w", err)
+	}
+	if err := timing.Validate(); err != nil {
+		return timing, err
+	}
+	return timing, nil
+}
+
+// routes returns the routes of the profile, or the ones of the configuration
+// file if the profile has none.
+func (p profile) routes() ([]util.Route, error) {
+	routes := p.Routes
+	if routes == nil {
+		if err := viper.UnmarshalKey("routes", &routes); err != nil {
+			return nil, fmt.Errorf("unable to read routes from the configuration file: %w", err)
+		}
+	}
+	for _, route := range routes {
+		if err := route.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return routes, nil
+}
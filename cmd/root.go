@@ -4,9 +4,12 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"log"
 	"os"
 
+	"github.com/clobrano/TaskwarriorAgenda/pkg/auth"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -28,5 +31,37 @@ func Execute() {
 }
 
 func init() {
+	cobra.OnInitialize(configureAuth)
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
+
+// configureAuth sets the authorization flow used when there is no token yet,
+// and where the token is stored, from the "auth" section of the configuration
+// file.
+func configureAuth() {
+	// The hooks do not authenticate, the flush they start does
+	if IsHookEvent(os.Args[1:]) {
+		return
+	}
+	if err := auth.Configure(authOptions()); err != nil {
+		log.Fatalf("Error in the auth section of the configuration file: %v", err)
+	}
+}
+
+// authOptions reads the "auth" section of the configuration file.
+func authOptions() auth.Options {
+	return auth.Options{
+		Flow:          viper.GetString("auth.flow"),
+		ListenAddress: viper.GetString("auth.listen"),
+		Token: auth.StoreOptions{
+			Backend:           viper.GetString("auth.token_store"),
+			Path:              viper.GetString("auth.token_path"),
+			PassphraseCommand: viper.GetString("auth.passphrase_command"),
+			KeyringCommand:    viper.GetString("auth.keyring_command"),
+		},
+		ServiceAccount: auth.ServiceAccountOptions{
+			KeyFile: viper.GetString("auth.service_account.key_file"),
+			Subject: viper.GetString("auth.service_account.subject"),
+		},
+	}
+}
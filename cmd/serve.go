@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/ical"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/source"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve tasks as an iCalendar subscription over HTTP",
+	Long: `Run an HTTP server exposing the tasks as an iCalendar feed at /calendar.ics,
+that phones and calendar applications can subscribe to without a Google account.
+The feed is regenerated from the source when it is older than --max-age.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		sourceName, _ := cmd.Flags().GetString("source")
+		filter, _ := cmd.Flags().GetString("filter")
+		kind, _ := cmd.Flags().GetString("type")
+		listen, _ := cmd.Flags().GetString("listen")
+		maxAge, _ := cmd.Flags().GetDuration("max-age")
+		if kind != ical.KindEvent && kind != ical.KindTodo && kind != ical.KindBoth {
+			log.Fatalf("Error: invalid type '%s'. Please use 'event', 'todo' or 'both'", kind)
+		}
+		if !cmd.Flags().Changed("listen") && viper.IsSet("serve.listen") {
+			listen = viper.GetString("serve.listen")
+		}
+
+		feed := ical.NewFeed(func() ([]byte, error) {
+			_, tasks, err := fetchTasks(profile{Source: sourceName, Filter: filter}, false)
+			if err != nil {
+				return nil, err
+			}
+			var data bytes.Buffer
+			err = ical.Encode(&data, ical.TasksToCalendar(tasks, kind))
+			return data.Bytes(), err
+		}, maxAge)
+		// Fail early on configuration errors
+		if err := feed.Refresh(); err != nil {
+			log.Fatalf("Error generating the calendar: %v", err)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/calendar.ics", basicAuth(feed, viper.GetString("serve.username"), viper.GetString("serve.password")))
+		srv := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			srv.Shutdown(shutdownCtx)
+		}()
+
+		log.Printf("Serving tasks at http://%s/calendar.ics", listen)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Error serving the calendar: %v", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().String("source", "", fmt.Sprintf("Source of tasks (%s)", strings.Join(source.Names(), ", ")))
+	serveCmd.MarkFlagRequired("source")
+	serveCmd.Flags().String("filter", "", "Filter to apply to the tasks")
+	serveCmd.Flags().String("type", ical.KindEvent, "Serve tasks as 'event', 'todo' or 'both'")
+	serveCmd.Flags().String("listen", "127.0.0.1:8080", "Address to listen on")
+	serveCmd.Flags().Duration("max-age", time.Minute, "How long a generated feed is served before reading the tasks again")
+}
+
+// basicAuth protects the handler with HTTP basic authentication, unless the
+// username is empty.
+func basicAuth(next http.Handler, username, password string) http.Handler {
+	if username == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="TaskwarriorAgenda", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
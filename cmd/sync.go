@@ -1,15 +1,26 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"text/tabwriter"
 	"time"
 
+	"github.com/clobrano/TaskwarriorAgenda/pkg/auth"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/caldav"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/engine"
 	"github.com/clobrano/TaskwarriorAgenda/pkg/google"
 	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
-	"github.com/clobrano/TaskwarriorAgenda/pkg/orgmode"
-	"github.com/clobrano/TaskwarriorAgenda/pkg/taskwarrior"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/source"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/state"
 	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -19,110 +30,473 @@ import (
 var syncCmd = &cobra.Command{
 	Use:   "sync",
 	Short: "Synchronize tasks to Google calendar",
-	Long:  `Synchronize tasks from Taskwarrior or an Org-mode file to Google calendar.`,
+	Long: `Synchronize tasks from Taskwarrior or an Org-mode file to Google calendar.
+
+The source, filter and calendar can be given with the flags, or with the
+named profiles of the configuration file.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		calendar, _ := cmd.Flags().GetString("calendar")
-		source, _ := cmd.Flags().GetString("source")
-		filter, _ := cmd.Flags().GetString("filter")
+		twoWay, _ := cmd.Flags().GetBool("two-way")
+		prune, _ := cmd.Flags().GetBool("prune")
+		pruneGrace, _ := cmd.Flags().GetDuration("prune-grace")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		output, _ := cmd.Flags().GetString("output")
+		if output != "table" && output != "json" {
+			log.Fatalf("Error: invalid output '%s'. Please use 'table' or 'json'", output)
+		}
+		watch, _ := cmd.Flags().GetBool("watch")
+		debounce, _ := cmd.Flags().GetDuration("debounce")
+		poll, _ := cmd.Flags().GetDuration("poll")
+		if watch && dryRun {
+			log.Fatalf("Error: --watch cannot be used with --dry-run")
+		}
+		if !cmd.Flags().Changed("prune-grace") && viper.IsSet("prune_grace_period") {
+			pruneGrace = viper.GetDuration("prune_grace_period")
+		}
 
-		var tasks []model.Task
-		var err error
+		profiles, err := syncProfiles(cmd)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		store, err := loadStore()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
 
-		switch source {
-		case "orgmode":
-			// Get the list of Org-mode files from the configuration
-			files := viper.GetStringSlice("orgmode_files")
-			if len(files) == 0 {
-				log.Fatal("Error: no Org-mode files specified in the configuration file")
-			}
-			tasks, err = orgmode.ParseFiles(files)
-			if err != nil {
-				log.Fatalf("Error parsing Org-mode files: %v", err)
-			}
-			if filter != "" {
-				tasks = orgmode.FilterTasks(tasks, filter)
-			}
-		case "taskwarrior":
-			client := taskwarrior.NewClient()
-			twTasks, err := client.GetTasks(strings.Split(filter, " "))
+		var grace time.Duration = -1
+		if prune {
+			grace = pruneGrace
+		}
+		var plan string
+		if dryRun {
+			plan = output
+		}
+
+		// All the profiles share the same state and calendar client
+		clients := &calendarClients{}
+		var runs []*profileSync
+		for _, p := range profiles {
+			run, err := newProfileSync(p, clients, store, twoWay, grace, plan)
 			if err != nil {
-				log.Fatalf("Error getting tasks from Taskwarrior: %v", err)
-			}
-			// Convert taskwarrior.Task to model.Task
-			for _, t := range twTasks {
-				var deadline time.Time
-				if t.Due != nil {
-					deadline = t.Due.Time
+				if len(profiles) == 1 {
+					log.Fatalf("Error: %v", err)
 				}
-				tasks = append(tasks, model.Task{
-					ID:          t.UUID,
-					Description: t.Description,
-					Deadline:    deadline,
-					Status:      t.Status,
-					Source:      "taskwarrior",
-				})
+				log.Printf("Error: skipping profile %s: %v", p.Name, err)
+				continue
 			}
-		default:
-			log.Fatalf("Error: invalid source '%s'. Please use 'taskwarrior' or 'orgmode'", source)
+			runs = append(runs, run)
+		}
+		if len(runs) == 0 {
+			log.Fatalf("Error: no profile could be synced")
+		}
+		if err := checkOverlap(runs); err != nil {
+			log.Fatalf("Error: %v", err)
 		}
 
-		sync(calendar, tasks)
+		if watch {
+			watchTasks(runs, twoWay, debounce, poll)
+			return
+		}
+		for _, run := range runs {
+			if run.profile.Name != "" && output == "table" {
+				fmt.Printf("Profile %s\n", run.profile.Name)
+			}
+			run.job.run(run.tasks, run.tasks)
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(syncCmd)
-	syncCmd.Flags().String("calendar", "Tasks", "Google Calendar name to sync with")
-	syncCmd.Flags().String("source", "", "Source of tasks (taskwarrior or orgmode)")
-	syncCmd.MarkFlagRequired("source")
+	syncCmd.Flags().String("calendar", defaultCalendar, "Google Calendar name or ID to sync with")
+	syncCmd.Flags().String("source", "", fmt.Sprintf("Source of tasks (%s)", strings.Join(source.Names(), ", ")))
 	syncCmd.Flags().String("filter", "", "Filter to apply to the tasks")
+	syncCmd.Flags().String("profile", "", "Sync the profile with this name from the configuration file")
+	syncCmd.Flags().Bool("all-profiles", false, "Sync all the profiles of the configuration file")
+	syncCmd.Flags().Bool("two-way", false, "Apply the changes made on the calendar back to the tasks")
+	syncCmd.Flags().Bool("prune", false, "Delete the events of tasks no longer returned by the same source and filter")
+	syncCmd.Flags().Duration("prune-grace", 24*time.Hour, "How long a task must be missing before its event is pruned")
+	syncCmd.Flags().Bool("dry-run", false, "Print the changes that would be made, without making them")
+	syncCmd.Flags().String("output", "table", "Format of the dry-run plan (table or json)")
+	syncCmd.Flags().Bool("watch", false, "Keep running and sync again when the tasks change")
+	syncCmd.Flags().Duration("debounce", 2*time.Second, "How long the tasks must be left unchanged before syncing them again, with --watch")
+	syncCmd.Flags().Duration("poll", 5*time.Minute, "How often to read the changes made on the calendar, with --watch (0 to disable)")
+}
+
+// syncProfiles returns the profiles selected by the flags: all the profiles,
+// the one given with --profile, with the flags overriding its settings, or
+// the one made of the flags alone.
+func syncProfiles(cmd *cobra.Command) ([]profile, error) {
+	name, _ := cmd.Flags().GetString("profile")
+	all, _ := cmd.Flags().GetBool("all-profiles")
+
+	if all {
+		if name != "" {
+			return nil, fmt.Errorf("--profile cannot be used with --all-profiles")
+		}
+		for _, flag := range []string{"source", "filter", "calendar"} {
+			if cmd.Flags().Changed(flag) {
+				return nil, fmt.Errorf("--%s cannot be used with --all-profiles", flag)
+			}
+		}
+		return loadProfiles()
+	}
+
+	var p profile
+	if name != "" {
+		var err error
+		if p, err = loadProfile(name); err != nil {
+			return nil, err
+		}
+	}
+	if cmd.Flags().Changed("source") || name == "" {
+		p.Source, _ = cmd.Flags().GetString("source")
+	}
+	if cmd.Flags().Changed("filter") || name == "" {
+		p.Filter, _ = cmd.Flags().GetString("filter")
+	}
+	if cmd.Flags().Changed("calendar") || name == "" {
+		p.Calendar, _ = cmd.Flags().GetString("calendar")
+	}
+	if p.Source == "" {
+		return nil, fmt.Errorf("required flag \"source\" not set, or use --profile or --all-profiles")
+	}
+	return []profile{p}, nil
 }
 
-func sync(calendarName string, tasks []model.Task) {
-	client, err := google.NewClient(calendarName)
+// fetchTasks returns the source of the profile and the tasks selected by its
+// filter, placed in the calendar according to its timing rules. When twoWay
+// is true, the source is prepared for writing changes back.
+func fetchTasks(p profile, twoWay bool) (source.Source, []model.Task, error) {
+	timing, err := p.timing()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	src, err := source.New(p.Source, source.Options{
+		Files:  viper.GetStringSlice("orgmode_files"),
+		Timing: timing,
+		TwoWay: twoWay,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	tasks, err := src.Fetch(context.Background(), p.Filter)
 	if err != nil {
-		log.Fatalf("Error creating Google Calendar client: %v", err)
+		return nil, nil, fmt.Errorf("unable to get tasks from %s: %w", p.Source, err)
 	}
 
-	// Create a map of task IDs for efficient lookup
-	taskMap := make(map[string]bool)
-	for _, task := range tasks {
-		taskMap[task.ID] = true
+	for i := range tasks {
+		util.ApplyTiming(&tasks[i], timing)
+		tasks[i].Color = p.Color
 	}
+	return src, tasks, nil
+}
 
-	// TODO: improve orphaned events management. For now it is disabled
-	// the problem is that looking for all the events will take more and more
-	// time in the future, since we'll have more and more events in history.
-	// The solution is to look only in Orgmode.md not in Orgmode_archive.md. However,
-	// as of today implementation, removing the latter from the watch list, will make a
-	// bunch of events form the Calendar "orphaned" and so deleted.
+// profileSync is a profile ready to be synced.
+type profileSync struct {
+	profile profile
+	src     source.Source
+	tasks   []model.Task
+	job     *syncJob
+	// synced are the hashes of the tasks synced by the last run, by task
+	// ID, used by --watch to sync only the tasks that changed.
+	synced map[string]string
+}
+
+// newProfileSync reads the tasks of the profile and creates the job syncing
+// them to its calendar.
+func newProfileSync(p profile, clients *calendarClients, store *state.Store, twoWay bool, pruneGrace time.Duration, plan string) (*profileSync, error) {
+	src, tasks, err := fetchTasks(p, twoWay && plan == "")
+	if err != nil {
+		return nil, err
+	}
 
-	if false {
-		// Fetch recent events to check for orphans
-		events, err := client.ListEvents(time.Now().Add(-30 * 24 * time.Hour))
+	// Only sources implementing model.Writer support two-way sync
+	var writer model.Writer
+	if w, ok := src.(model.Writer); ok && twoWay {
+		writer = w
+	} else if twoWay {
+		log.Printf("Source %s does not support two-way sync, syncing one way", p.Source)
+	}
+
+	routes, err := p.routes()
+	if err != nil {
+		return nil, err
+	}
+	job, err := newSyncJob(clients, store, p.Calendar, routes)
+	if err != nil {
+		return nil, err
+	}
+	job.scopes = src.Scopes(p.Filter)
+	job.pruneGrace = pruneGrace
+	job.writer = writer
+	if job.timing, err = p.timing(); err != nil {
+		return nil, err
+	}
+	job.plan = plan
+	return &profileSync{profile: p, src: src, tasks: tasks, job: job}, nil
+}
+
+// checkOverlap returns an error when a task is selected by more than one
+// profile. The state links each task to a single event: the profiles would
+// move it back and forth between their calendars, or prune it.
+func checkOverlap(runs []*profileSync) error {
+	owners := make(map[string]string)
+	for _, run := range runs {
+		for _, task := range run.tasks {
+			if owner, ok := owners[task.ID]; ok && owner != run.profile.Name {
+				return fmt.Errorf("task '%s' is selected by both profiles %s and %s, their filters must not overlap", task.Description, owner, run.profile.Name)
+			}
+			owners[task.ID] = run.profile.Name
+		}
+	}
+	return nil
+}
+
+// syncJob pushes tasks to calendars. It is created once and run for every
+// sync, so that --watch reuses the same calendar clients.
+type syncJob struct {
+	// backends are the calendars the tasks are synced to, by name. The
+	// routes tell which one each task goes to, defaultCalendar being the one
+	// of the tasks matching no route.
+	backends        map[string]backend.CalendarBackend
+	routes          []util.Route
+	defaultCalendar string
+	store           *state.Store
+	// scopes are the scopes of the synced tasks. When pruneGrace is not
+	// negative, the events of tasks that disappeared from them are pruned.
+	scopes     []string
+	pruneGrace time.Duration
+	// writer, when not nil, writes the calendar-side changes back. timing
+	// are the rules the events were placed with.
+	writer model.Writer
+	timing util.TimingRules
+	// plan, when not empty, is the format (table or json) the planned
+	// changes are printed in, instead of making them.
+	plan string
+}
+
+// newSyncJob creates the job syncing tasks to the default calendar, or to the
+// calendar of the route they match. It does not prune, nor write back.
+func newSyncJob(clients *calendarClients, store *state.Store, defaultCalendar string, routes []util.Route) (*syncJob, error) {
+	if len(routes) > 0 && viper.GetString("backend") == "caldav" {
+		log.Printf("Routes are not supported by the CalDAV backend, syncing all tasks to %s", viper.GetString("caldav.url"))
+		routes = nil
+	}
+
+	job := &syncJob{
+		backends:        make(map[string]backend.CalendarBackend),
+		routes:          routes,
+		defaultCalendar: defaultCalendar,
+		store:           store,
+		pruneGrace:      -1,
+	}
+	// Calendars without tasks are synced too, to prune their events
+	names := []string{defaultCalendar}
+	for _, route := range routes {
+		names = append(names, route.Calendar)
+	}
+	for _, name := range names {
+		if _, ok := job.backends[name]; ok {
+			continue
+		}
+		be, err := clients.backend(name)
 		if err != nil {
-			log.Fatalf("Error fetching calendar events: %v", err)
+			return nil, fmt.Errorf("unable to create calendar client: %w", err)
 		}
+		job.backends[name] = be
+	}
+	return job, nil
+}
 
-		// Delete orphaned events
-		for _, event := range events {
-			taskID, found := util.GetTaskIDFromEventDescription(event.Description)
-			if found && !taskMap[taskID] {
-				log.Printf("Deleting orphaned event for task '%s' ID %s", event.Description, taskID)
-				err := client.DeleteEvent(event.Id)
-				if err != nil {
-					log.Printf("Error deleting event: %v", err)
-				}
-			}
+// loadStore loads the sync state.
+func loadStore() (*state.Store, error) {
+	xdgConfigBase, err := auth.GetXdgHome()
+	if err != nil {
+		return nil, fmt.Errorf("could not find path to configuration directory: %w", err)
+	}
+	store, err := state.Load(filepath.Join(xdgConfigBase, state.StateFile))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load sync state: %w", err)
+	}
+	return store, nil
+}
+
+// run syncs the changed tasks, which are all the tasks for a full sync, and
+// prunes the events of the tasks no longer in tasks. It returns what
+// happened to each task. Other processes syncing at the same time are waited
+// for.
+func (j *syncJob) run(tasks, changed []model.Task) []engine.Outcome {
+	unlock, err := j.store.Lock()
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return failAll(changed, err)
+	}
+	defer unlock()
+
+	names := make([]string, 0, len(j.backends))
+	clients := make(map[string]*engine.Engine, len(j.backends))
+	for name, be := range j.backends {
+		client := engine.New(be, j.store)
+		if j.writer != nil {
+			client.EnableTwoWay(j.writer, viper.GetStringMapString("two_way.conflicts"), j.timing)
 		}
+		client.SetDryRun(j.plan != "")
+		clients[name] = client
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
 	// Sync current tasks
-	for _, task := range tasks {
-		fmt.Printf("Syncing task: '%s', uuid: %s, due: %s\n", task.Description, task.ID, task.Deadline)
-		_, err := client.SyncEvent(task)
-		if err != nil {
+	for _, task := range changed {
+		calendar := util.RouteTask(j.routes, &task, j.defaultCalendar)
+		if j.plan == "" {
+			fmt.Printf("Syncing task: '%s', uuid: %s, due: %s, calendar: %s\n", task.Description, task.ID, task.Deadline, calendar)
+		}
+		if err := clients[calendar].SyncEvent(task); err != nil {
 			fmt.Printf("Error syncing event for task %s: %v\n", task.Description, err)
 		}
 	}
+
+	// Tasks routed to another calendar are not orphans of this one
+	if j.pruneGrace >= 0 {
+		for _, name := range names {
+			clients[name].PruneOrphans(j.scopes, tasks, j.pruneGrace)
+		}
+	}
+
+	var outcomes []engine.Outcome
+	for _, name := range names {
+		outcomes = append(outcomes, clients[name].Flush()...)
+	}
+	if j.plan != "" {
+		if err := printPlan(os.Stdout, outcomes, j.plan); err != nil {
+			log.Printf("Error printing the sync plan: %v", err)
+		}
+		// Nothing was synced: the state must stay as it was
+		return outcomes
+	}
+
+	// Report what happened to each task
+	printOutcomes(outcomes)
+
+	if err := j.store.Save(); err != nil {
+		log.Printf("Error saving sync state: %v", err)
+	}
+	return outcomes
+}
+
+// failAll reports that none of the tasks could be synced.
+func failAll(tasks []model.Task, err error) []engine.Outcome {
+	outcomes := make([]engine.Outcome, len(tasks))
+	for i, task := range tasks {
+		outcomes[i] = engine.Outcome{TaskID: task.ID, Description: task.Description, Action: engine.ActionSkip, Err: err}
+	}
+	return outcomes
+}
+
+// calendarClients creates the calendar backends selected by the "backend"
+// key of the configuration file: Google Calendar (the default), where the
+// calendars are looked up by ID or name, created when missing if the
+// "google" section allows it, and share the same authenticated client, or the
+// CalDAV calendar configured in the "caldav" section.
+type calendarClients struct {
+	google *google.Service
+}
+
+// backend returns the backend of the calendar with the given name.
+func (c *calendarClients) backend(calendarName string) (backend.CalendarBackend, error) {
+	switch name := viper.GetString("backend"); name {
+	case "", "google":
+		if c.google == nil {
+			service, err := google.NewService(google.CalendarOptions{
+				Create:   viper.GetBool("google.create_calendars"),
+				TimeZone: viper.GetString("google.time_zone"),
+				Color:    viper.GetString("google.calendar_color"),
+			})
+			if err != nil {
+				return nil, err
+			}
+			c.google = service
+		}
+		return c.google.Backend(calendarName)
+	case "caldav":
+		return caldav.NewClient(
+			viper.GetString("caldav.url"),
+			viper.GetString("caldav.username"),
+			viper.GetString("caldav.password"),
+		)
+	default:
+		return nil, fmt.Errorf("invalid backend '%s'. Please use 'google' or 'caldav'", name)
+	}
+}
+
+// printOutcomes prints how many tasks were created, updated, deleted or
+// skipped, followed by the tasks that could not be synced.
+func printOutcomes(outcomes []engine.Outcome) {
+	counts := make(map[string]int)
+	var failures []engine.Outcome
+	for _, outcome := range outcomes {
+		if outcome.Err != nil {
+			failures = append(failures, outcome)
+			continue
+		}
+		counts[outcome.Action]++
+	}
+
+	fmt.Printf("Sync summary: %d created, %d updated, %d deleted, %d unchanged, %d failed\n",
+		counts[engine.ActionCreate], counts[engine.ActionUpdate], counts[engine.ActionDelete],
+		counts[engine.ActionSkip], len(failures))
+	for _, failure := range failures {
+		fmt.Printf("  failed to %s '%s' (%s): %v\n", failure.Action, failure.Description, failure.TaskID, failure.Err)
+	}
+}
+
+// plannedChange is the JSON representation of a dry-run outcome.
+type plannedChange struct {
+	Action      string             `json:"action"`
+	TaskID      string             `json:"task_id"`
+	Description string             `json:"description"`
+	Reason      string             `json:"reason,omitempty"`
+	Changes     []util.FieldChange `json:"changes,omitempty"`
+	Error       string             `json:"error,omitempty"`
+}
+
+// printPlan prints the changes a dry-run sync would make, as a table or as
+// JSON.
+func printPlan(w io.Writer, outcomes []engine.Outcome, format string) error {
+	plan := make([]plannedChange, 0, len(outcomes))
+	for _, outcome := range outcomes {
+		change := plannedChange{
+			Action:      outcome.Action,
+			TaskID:      outcome.TaskID,
+			Description: outcome.Description,
+			Reason:      outcome.Reason,
+			Changes:     outcome.Changes,
+		}
+		if outcome.Err != nil {
+			change.Error = outcome.Err.Error()
+		}
+		plan = append(plan, change)
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tTASK\tDESCRIPTION\tDETAILS")
+	for _, change := range plan {
+		details := change.Reason
+		if change.Error != "" {
+			details = "error: " + change.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", change.Action, change.TaskID, change.Description, details)
+		for _, field := range change.Changes {
+			fmt.Fprintf(tw, "\t\t  %s\t'%s' -> '%s'\n", field.Field, field.Old, field.New)
+		}
+	}
+	return tw.Flush()
 }
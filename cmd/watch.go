@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/engine"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/source"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/watch"
+)
+
+// watchTasks syncs the profiles and keeps the calendars in sync until
+// interrupted. When the files of the sources change, the tasks are read again
+// and only the ones that changed since the previous sync are synced. Every
+// poll interval all the tasks are synced, to pick up the changes made on the
+// calendars.
+func watchTasks(runs []*profileSync, twoWay bool, debounce, poll time.Duration) {
+	var paths []string
+	for _, run := range runs {
+		w, ok := run.src.(source.Watcher)
+		if !ok {
+			log.Fatalf("Error: source %s cannot be watched", run.profile.Source)
+		}
+		sourcePaths, err := w.WatchPaths()
+		if err != nil {
+			log.Fatalf("Error: unable to find the files of source %s: %v", run.profile.Source, err)
+		}
+		paths = append(paths, sourcePaths...)
+	}
+	watcher, err := watch.New(paths, debounce)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	defer watcher.Close()
+
+	var ticks <-chan time.Time
+	if poll > 0 {
+		ticker := time.NewTicker(poll)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for _, run := range runs {
+		run.synced = taskHashes(run.tasks, run.job.run(run.tasks, run.tasks))
+	}
+
+	log.Printf("Watching %v for changes", paths)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopped watching")
+			return
+		case changed, ok := <-watcher.Changes():
+			if !ok {
+				return
+			}
+			log.Printf("Tasks changed in %v", changed)
+			for _, run := range runs {
+				run.resync(runs, twoWay, false)
+			}
+		case <-ticks:
+			for _, run := range runs {
+				run.resync(runs, twoWay, true)
+			}
+		}
+	}
+}
+
+// resync reads the tasks of the profile again and syncs all of them, or only
+// the ones that changed since the previous sync. Nothing is synced when the
+// tasks now overlap with the ones of the other runs.
+func (r *profileSync) resync(runs []*profileSync, twoWay, all bool) {
+	_, tasks, err := fetchTasks(r.profile, twoWay)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return
+	}
+	previous := r.tasks
+	r.tasks = tasks
+	if err := checkOverlap(runs); err != nil {
+		r.tasks = previous
+		log.Printf("Error: not syncing profile %s: %v", r.profile.Name, err)
+		return
+	}
+	changed := tasks
+	if !all {
+		changed = nil
+		for i := range tasks {
+			if r.synced[tasks[i].ID] != util.TaskHash(&tasks[i]) {
+				changed = append(changed, tasks[i])
+			}
+		}
+	}
+	r.synced = taskHashes(tasks, r.job.run(tasks, changed))
+}
+
+// taskHashes returns the hashes of the synced tasks, by task ID. The tasks
+// that failed to sync are left out, so that they are synced again.
+func taskHashes(tasks []model.Task, outcomes []engine.Outcome) map[string]string {
+	failed := make(map[string]bool)
+	for _, outcome := range outcomes {
+		if outcome.Err != nil {
+			failed[outcome.TaskID] = true
+		}
+	}
+	hashes := make(map[string]string, len(tasks))
+	for i := range tasks {
+		if !failed[tasks[i].ID] {
+			hashes[tasks[i].ID] = util.TaskHash(&tasks[i])
+		}
+	}
+	return hashes
+}
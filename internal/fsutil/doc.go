@@ -0,0 +1,3 @@
+// Package fsutil holds the file helpers shared by the packages writing
+// files: the state, the token, the Org-mode files and the exports.
+package fsutil
@@ -0,0 +1,53 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	for _, tt := range []struct {
+		data string
+		perm os.FileMode
+	}{
+		{data: "first", perm: 0600},
+		{data: "second", perm: 0644},
+	} {
+		if err := WriteFileAtomic(path, []byte(tt.data), tt.perm); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.data {
+			t.Errorf("got %q, want %q", got, tt.data)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != tt.perm {
+			t.Errorf("got mode %v, want %v", info.Mode().Perm(), tt.perm)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files, want the temporary file removed", len(entries))
+	}
+}
+
+func TestWriteFileAtomicMissingDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "state.json")
+	if err := WriteFileAtomic(path, []byte("data"), 0600); err == nil {
+		t.Error("got no error writing to a missing directory")
+	}
+}
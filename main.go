@@ -4,6 +4,7 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -13,10 +14,24 @@ import (
 )
 
 func main() {
+	if err := readConfig(); err != nil {
+		// The Taskwarrior hooks do not need the configuration, and must pass
+		// the task through whatever happens, or Taskwarrior rejects it
+		if !cmd.IsHookEvent(os.Args[1:]) {
+			log.Fatal(err)
+		}
+		cmd.HookLogf("%v", err)
+	}
+
+	cmd.Execute()
+}
+
+// readConfig reads the configuration file.
+func readConfig() error {
 	// Get the XDG config directory
 	xdgConfigDir, err := os.UserConfigDir()
 	if err != nil {
-		log.Fatalf("Error getting config directory: %s", err)
+		return fmt.Errorf("Error getting config directory: %w", err)
 	}
 	configDir := filepath.Join(xdgConfigDir, "taskwarrior-agenda")
 
@@ -28,8 +43,7 @@ func main() {
 
 	// Read the configuration file
 	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalf("Error reading config file, %s", err)
+		return fmt.Errorf("Error reading config file, %w", err)
 	}
-
-	cmd.Execute()
+	return nil
 }
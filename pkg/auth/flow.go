@@ -0,0 +1,318 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// The flows the user can authorize the application with.
+const (
+	// FlowBrowser opens the authorization page in a browser on the same
+	// machine, and receives the code on a local web server.
+	FlowBrowser = "browser"
+	// FlowManual lets the user paste the address the browser is redirected
+	// to, or the code, for machines the browser cannot reach.
+	FlowManual = "manual"
+	// FlowDevice shows a code to enter on any device with a browser (OAuth
+	// device authorization grant). Where the credentials or the scopes do
+	// not allow it, it falls back to FlowManual.
+	FlowDevice = "device"
+)
+
+// errDeviceUnsupported is returned by getTokenFromDevice when the
+// authorization server refuses the device grant for the credentials or the
+// scopes. Google only allows a few scopes with it, not the Calendar ones.
+var errDeviceUnsupported = errors.New("device authorization not allowed for these credentials and scopes")
+
+// deviceTimeout is how long the device flow waits for the user when the
+// server does not tell when the code expires.
+const deviceTimeout = 10 * time.Minute
+
+// oobRedirectURL is the deprecated out-of-band redirect URL.
+const oobRedirectURL = "urn:ietf:wg:oauth:2.0:oob"
+
+// DefaultListenAddress is the address the browser flow listens on by
+// default: the loopback interface only, on a port picked by the system.
+const DefaultListenAddress = "127.0.0.1:0"
+
+// Options configure how the user authorizes the application when there is
+// no token yet, and where the token is kept.
+type Options struct {
+	// Flow is FlowBrowser (the default), FlowManual or FlowDevice.
+	Flow string
+	// ListenAddress is the host:port the browser flow receives the redirect
+	// on, and the manual flow redirects to. Port 0 lets the system pick one.
+	ListenAddress string
+	// Token selects where the token is stored.
+	Token StoreOptions
+	// ServiceAccount, when its key is set, replaces the user authorization
+	// and its token.
+	ServiceAccount ServiceAccountOptions
+}
+
+var options = Options{Flow: FlowBrowser, ListenAddress: DefaultListenAddress}
+
+// Configure sets the options of the authorization flows. Empty fields keep
+// their default.
+func Configure(o Options) error {
+	switch o.Flow {
+	case "":
+		o.Flow = FlowBrowser
+	case FlowBrowser, FlowManual, FlowDevice:
+	default:
+		return fmt.Errorf("invalid authorization flow '%s'. Please use '%s', '%s' or '%s'", o.Flow, FlowBrowser, FlowManual, FlowDevice)
+	}
+	if o.ListenAddress == "" {
+		o.ListenAddress = DefaultListenAddress
+	}
+	if _, _, err := net.SplitHostPort(o.ListenAddress); err != nil {
+		return fmt.Errorf("invalid listen address '%s': %w", o.ListenAddress, err)
+	}
+	if _, err := NewTokenStore(o.Token); err != nil {
+		return err
+	}
+	if o.ServiceAccount.Subject != "" && o.ServiceAccount.KeyFile == "" {
+		return fmt.Errorf("service account subject '%s' set without a key file", o.ServiceAccount.Subject)
+	}
+	options = o
+	return nil
+}
+
+// getToken runs the configured authorization flow.
+func getToken(config *oauth2.Config) (*oauth2.Token, error) {
+	switch options.Flow {
+	case FlowManual:
+		return getTokenFromPaste(config, os.Stdin)
+	case FlowDevice:
+		tok, err := getTokenFromDevice(config, os.Stdout)
+		if errors.Is(err, errDeviceUnsupported) {
+			log.Printf("%v, using the %s flow instead", err, FlowManual)
+			return getTokenFromPaste(config, os.Stdin)
+		}
+		return tok, err
+	default:
+		return getTokenFromWeb(config, os.Stdout)
+	}
+}
+
+// redirectURL returns the loopback URL the browser is redirected to: the
+// listen address, with the path of the configured URL. A listen address on
+// all interfaces is reached as localhost, e.g. through an SSH tunnel. The
+// browser flow replaces port 0 with the port it listens on.
+func redirectURL(configured string) string {
+	host, port, _ := net.SplitHostPort(options.ListenAddress)
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	// The manual flow, the fallback of the device one, listens on nothing
+	if port == "0" && options.Flow != FlowBrowser {
+		port = LocalhostAuthPort
+	}
+	path := "/"
+	if u, err := url.Parse(configured); err == nil && configured != oobRedirectURL && u.Path != "" {
+		path = u.Path
+	}
+	return (&url.URL{Scheme: "http", Host: net.JoinHostPort(host, port), Path: path}).String()
+}
+
+// isLoopback tells whether the redirect URL points to the local machine.
+func isLoopback(redirect string) bool {
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(u.Hostname())
+	return u.Hostname() == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// randomState returns a random value for the state parameter, which ties the
+// redirect to the request of this flow.
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate the OAuth state: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// callbackResult is the outcome of the redirect of the browser flow.
+type callbackResult struct {
+	code string
+	err  error
+}
+
+// callbackHandler receives the redirect of the browser flow on path, and
+// delivers its outcome to results. Requests without the expected state are
+// rejected and do not end the flow, since they do not come from this
+// authorization request.
+func callbackHandler(path, state string, results chan<- callbackResult) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+			log.Printf("Ignoring OAuth2 redirect with an unexpected state")
+			http.Error(w, "Invalid state", http.StatusBadRequest)
+			return
+		}
+
+		var result callbackResult
+		switch {
+		case query.Get("error") != "":
+			result.err = fmt.Errorf("authorization denied: %s", query.Get("error"))
+			http.Error(w, "Authorization denied", http.StatusForbidden)
+		case query.Get("code") == "":
+			result.err = fmt.Errorf("authorization code not found in redirect URL")
+			http.Error(w, "Authorization code not found", http.StatusBadRequest)
+		default:
+			result.code = query.Get("code")
+			fmt.Fprintf(w, "Authentication successful! You can close this window.")
+		}
+		deliver(results, result)
+	})
+}
+
+// deliver sends the result unless one was already sent, so that it never
+// blocks.
+func deliver(results chan<- callbackResult, result callbackResult) {
+	select {
+	case results <- result:
+	default:
+	}
+}
+
+// getTokenFromPaste shows the authorization URL and reads from input the
+// address the browser is redirected to, or just the code. The redirect page
+// does not need to load, so this works when the browser runs on another
+// machine.
+func getTokenFromPaste(config *oauth2.Config, input io.Reader) (*oauth2.Token, error) {
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "consent"), oauth2.S256ChallengeOption(verifier))
+	fmt.Printf("Please open the following URL in a browser to authorize TaskwarriorAgenda:\n%s\n\n", authURL)
+	fmt.Printf("After authorizing, the browser is sent to %s, which is expected to fail loading.\n", config.RedirectURL)
+	fmt.Print("Paste the address of that page (or just the code) here: ")
+
+	line, err := bufio.NewReader(input).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, fmt.Errorf("unable to read the authorization code: %w", err)
+	}
+	code, err := codeFromInput(line, state)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tok, err := config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve token from Google: %w", err)
+	}
+	return tok, nil
+}
+
+// getTokenFromDevice runs the OAuth device authorization grant: it shows on
+// prompt the code to enter on any device with a browser, and polls the
+// authorization server until the user approves or denies the request.
+func getTokenFromDevice(config *oauth2.Config, prompt io.Writer) (*oauth2.Token, error) {
+	deviceConfig := *config
+	if deviceConfig.Endpoint.DeviceAuthURL == "" {
+		deviceConfig.Endpoint.DeviceAuthURL = google.Endpoint.DeviceAuthURL
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deviceTimeout)
+	defer cancel()
+	resp, err := deviceConfig.DeviceAuth(ctx)
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && deviceGrantRefused(retrieveErr) {
+			return nil, fmt.Errorf("%w: %s", errDeviceUnsupported, strings.TrimSpace(string(retrieveErr.Body)))
+		}
+		return nil, fmt.Errorf("unable to start device authorization: %w", err)
+	}
+
+	verification := resp.VerificationURIComplete
+	if verification == "" {
+		verification = resp.VerificationURI
+	}
+	fmt.Fprintf(prompt, "On any device, open %s and enter the code: %s\n", verification, resp.UserCode)
+	fmt.Fprintln(prompt, "Waiting for the authorization...")
+
+	tok, err := deviceConfig.DeviceAccessToken(ctx, resp)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization failed: %w", err)
+	}
+	return tok, nil
+}
+
+// deviceGrantRefused tells whether the error of the device authorization
+// request means that the grant is not allowed, rather than failed.
+func deviceGrantRefused(err *oauth2.RetrieveError) bool {
+	code := err.ErrorCode
+	if code == "" {
+		// The device authorization errors are not parsed by oauth2
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(err.Body, &body) == nil {
+			code = body.Error
+		}
+	}
+	switch code {
+	case "invalid_scope", "invalid_client", "unauthorized_client", "restricted_client":
+		return true
+	}
+	return false
+}
+
+// codeFromInput returns the authorization code of a pasted redirect URL, which
+// must carry the state of the request, or the pasted code itself.
+func codeFromInput(input, state string) (string, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return "", fmt.Errorf("no authorization code given")
+	}
+	if !strings.Contains(input, "?") {
+		return input, nil
+	}
+
+	u, err := url.Parse(input)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse the pasted address: %w", err)
+	}
+	query := u.Query()
+	if reason := query.Get("error"); reason != "" {
+		return "", fmt.Errorf("authorization denied: %s", reason)
+	}
+	// A pasted address must carry the state, or any redirect would do
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		return "", fmt.Errorf("the pasted address is not the answer to this authorization request")
+	}
+	code := query.Get("code")
+	if code == "" {
+		return "", fmt.Errorf("authorization code not found in the pasted address")
+	}
+	return code, nil
+}
@@ -0,0 +1,325 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestCallbackHandlerRejectsWrongState(t *testing.T) {
+	results := make(chan callbackResult, 1)
+	handler := callbackHandler("/", "expected", results)
+
+	for _, target := range []string{"/?state=other&code=c", "/?code=c"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+	select {
+	case result := <-results:
+		t.Fatalf("rejected callback delivered %+v", result)
+	default:
+	}
+}
+
+func TestCallbackHandlerWrongPath(t *testing.T) {
+	results := make(chan callbackResult, 1)
+	handler := callbackHandler("/callback", "expected", results)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/favicon.ico", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if len(results) != 0 {
+		t.Error("request on another path delivered a result")
+	}
+}
+
+func TestCallbackHandlerDoesNotBlock(t *testing.T) {
+	results := make(chan callbackResult, 1)
+	handler := callbackHandler("/", "expected", results)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, code := range []string{"first", "second", "third"} {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?state=expected&code="+code, nil))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler blocked on a second callback")
+	}
+	if result := <-results; result.code != "first" || result.err != nil {
+		t.Errorf("got %+v, want the first code", result)
+	}
+}
+
+func TestCallbackHandlerDenied(t *testing.T) {
+	results := make(chan callbackResult, 1)
+	handler := callbackHandler("/", "expected", results)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?state=expected&error=access_denied", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if result := <-results; result.err == nil {
+		t.Error("denied authorization delivered no error")
+	}
+}
+
+func TestCodeFromInput(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "bare code", input: " 4/abc \n", want: "4/abc"},
+		{name: "address", input: "http://127.0.0.1:6789/?state=s1&code=4/abc", want: "4/abc"},
+		{name: "address without state", input: "http://127.0.0.1:6789/?code=4/abc", wantErr: true},
+		{name: "address with other state", input: "http://127.0.0.1:6789/?state=s2&code=4/abc", wantErr: true},
+		{name: "denied", input: "http://127.0.0.1:6789/?state=s1&error=access_denied", wantErr: true},
+		{name: "address without code", input: "http://127.0.0.1:6789/?state=s1", wantErr: true},
+		{name: "empty", input: "\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := codeFromInput(tt.input, "s1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got code %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// tokenServer answers the token requests with the code "good", and records
+// the PKCE verifiers it receives.
+func tokenServer(t *testing.T) (*httptest.Server, chan string) {
+	verifiers := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parsing token request: %v", err)
+		}
+		verifiers <- r.Form.Get("code_verifier")
+		if r.Form.Get("code") != "good" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"access_token":"access","refresh_token":"refresh","token_type":"Bearer","expires_in":3600}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, verifiers
+}
+
+// checkChallenge checks that the authorization URL carries the S256
+// challenge of the verifier.
+func checkChallenge(t *testing.T, authURL *url.URL, verifier string) {
+	t.Helper()
+	if verifier == "" {
+		t.Fatal("no code_verifier sent on exchange")
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	query := authURL.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Errorf("code_challenge %q (%s) does not match the verifier", query.Get("code_challenge"), query.Get("code_challenge_method"))
+	}
+}
+
+// urlWriter sends the URL of the lines written to it.
+type urlWriter chan *url.URL
+
+func (w urlWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(string(p), "\n") {
+		if u, err := url.Parse(line); err == nil && u.Scheme != "" {
+			w <- u
+		}
+	}
+	return len(p), nil
+}
+
+func TestGetTokenFromWeb(t *testing.T) {
+	server, verifiers := tokenServer(t)
+	options.ListenAddress = DefaultListenAddress
+	config := &oauth2.Config{
+		ClientID:    "client",
+		Endpoint:    oauth2.Endpoint{AuthURL: server.URL + "/auth", TokenURL: server.URL + "/token"},
+		RedirectURL: redirectURL(""),
+	}
+
+	prompt := make(urlWriter, 1)
+	type flowResult struct {
+		tok *oauth2.Token
+		err error
+	}
+	done := make(chan flowResult, 1)
+	go func() {
+		tok, err := getTokenFromWeb(config, prompt)
+		done <- flowResult{tok, err}
+	}()
+
+	var authURL *url.URL
+	select {
+	case authURL = <-prompt:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no authorization URL shown")
+	}
+	query := authURL.Query()
+	redirect := query.Get("redirect_uri")
+	if !strings.HasPrefix(redirect, "http://127.0.0.1:") || strings.HasSuffix(redirect, ":0/") {
+		t.Fatalf("redirect_uri %s is not the bound loopback port", redirect)
+	}
+	if len(query.Get("state")) < 32 {
+		t.Fatalf("state %q is not random", query.Get("state"))
+	}
+
+	resp, err := http.Get(redirect + "?state=forged&code=bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("forged callback got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	resp, err = http.Get(redirect + "?" + url.Values{"state": {query.Get("state")}, "code": {"good"}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var result flowResult
+	select {
+	case result = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow did not end after the callback")
+	}
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if result.tok.AccessToken != "access" {
+		t.Errorf("got access token %q", result.tok.AccessToken)
+	}
+	checkChallenge(t, authURL, <-verifiers)
+
+	// The server is shut down once the flow ends
+	http.DefaultClient.CloseIdleConnections()
+	if resp, err := http.Get(redirect); err == nil {
+		resp.Body.Close()
+		t.Error("callback server still running after the flow")
+	}
+}
+
+func TestGetTokenFromPaste(t *testing.T) {
+	server, verifiers := tokenServer(t)
+	config := &oauth2.Config{
+		ClientID:    "client",
+		Endpoint:    oauth2.Endpoint{AuthURL: server.URL + "/auth", TokenURL: server.URL + "/token"},
+		RedirectURL: "http://127.0.0.1:6789/",
+	}
+
+	if _, err := getTokenFromPaste(config, strings.NewReader("good\n")); err != nil {
+		t.Fatal(err)
+	}
+	if verifier := <-verifiers; verifier == "" {
+		t.Error("no code_verifier sent on exchange")
+	}
+}
+
+// deviceServer is an authorization server running the device grant. The
+// token is given at the second poll, after an authorization_pending answer.
+func deviceServer(t *testing.T, refuse string) *httptest.Server {
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parsing %s request: %v", r.URL.Path, err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/device":
+			if refuse != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"error":"`+refuse+`"}`)
+				return
+			}
+			io.WriteString(w, `{"device_code":"device","user_code":"ABCD-EFGH","verification_url":"https://example.com/device","expires_in":60,"interval":1}`)
+		case "/token":
+			if r.Form.Get("device_code") != "device" {
+				t.Errorf("got device_code %q", r.Form.Get("device_code"))
+			}
+			if polls++; polls == 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"error":"authorization_pending"}`)
+				return
+			}
+			io.WriteString(w, `{"access_token":"access","refresh_token":"refresh","token_type":"Bearer","expires_in":3600}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGetTokenFromDevice(t *testing.T) {
+	server := deviceServer(t, "")
+	config := &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{DeviceAuthURL: server.URL + "/device", TokenURL: server.URL + "/token"},
+	}
+
+	var prompt strings.Builder
+	tok, err := getTokenFromDevice(config, &prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.RefreshToken != "refresh" {
+		t.Errorf("got token %+v", tok)
+	}
+	if !strings.Contains(prompt.String(), "https://example.com/device") || !strings.Contains(prompt.String(), "ABCD-EFGH") {
+		t.Errorf("prompt %q lacks the verification URL or the code", prompt.String())
+	}
+}
+
+func TestGetTokenFromDeviceRefused(t *testing.T) {
+	tests := []struct {
+		refuse      string
+		unsupported bool
+	}{
+		{refuse: "invalid_scope", unsupported: true},
+		{refuse: "invalid_client", unsupported: true},
+		{refuse: "access_denied", unsupported: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.refuse, func(t *testing.T) {
+			server := deviceServer(t, tt.refuse)
+			config := &oauth2.Config{
+				ClientID: "client",
+				Endpoint: oauth2.Endpoint{DeviceAuthURL: server.URL + "/device", TokenURL: server.URL + "/token"},
+			}
+			_, err := getTokenFromDevice(config, io.Discard)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if errors.Is(err, errDeviceUnsupported) != tt.unsupported {
+				t.Errorf("got error %v, want the manual fallback %t", err, tt.unsupported)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+)
+
+// ServiceAccountOptions configure the authentication as a service account,
+// which needs no user interaction, e.g. to sync from CI or cron. The
+// calendars must be shared with the service account, unless it impersonates
+// a user.
+type ServiceAccountOptions struct {
+	// KeyFile is the JSON key of the service account. A relative path is in
+	// the configuration directory.
+	KeyFile string
+	// Subject is the email of the user to impersonate through domain-wide
+	// delegation, if any.
+	Subject string
+}
+
+// UsesServiceAccount tells whether the application authenticates as a
+// service account instead of a user.
+func UsesServiceAccount() bool {
+	return options.ServiceAccount.KeyFile != ""
+}
+
+// serviceAccountConfig reads the key of the service account.
+func serviceAccountConfig(o ServiceAccountOptions, scopes []string) (*jwt.Config, error) {
+	path := o.KeyFile
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, strings.TrimPrefix(path, "~"))
+	} else if !filepath.IsAbs(path) {
+		xdgConfigBase, err := GetXdgHome()
+		if err != nil {
+			return nil, fmt.Errorf("could not find path to configuration directory: %w", err)
+		}
+		path = filepath.Join(xdgConfigBase, path)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account key %s: %w", path, err)
+	}
+	config, err := google.JWTConfigFromJSON(b, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse service account key %s: %w", path, err)
+	}
+	config.Subject = o.Subject
+	return config, nil
+}
+
+// serviceAccountClient returns a client authenticated as the service
+// account, impersonating the subject if any.
+func serviceAccountClient(ctx context.Context, o ServiceAccountOptions, scopes []string) (*http.Client, error) {
+	config, err := serviceAccountConfig(o, scopes)
+	if err != nil {
+		return nil, err
+	}
+	return config.Client(ctx), nil
+}
+
+// CheckServiceAccount checks that Google issues a token to the configured
+// service account, and returns its email.
+func CheckServiceAccount(ctx context.Context) (string, error) {
+	config, err := serviceAccountConfig(options.ServiceAccount, Scopes)
+	if err != nil {
+		return "", err
+	}
+	if _, err := config.TokenSource(ctx).Token(); err != nil {
+		return "", fmt.Errorf("service account %s cannot authenticate: %w", config.Email, err)
+	}
+	return config.Email, nil
+}
@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/option"
+)
+
+// Google endpoints to inspect and revoke tokens.
+var (
+	tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+	revokeURL    = "https://oauth2.googleapis.com/revoke"
+)
+
+// Status describes the credentials the application authenticates with.
+type Status struct {
+	// Account is the email of the Google account, if it could be read.
+	Account string
+	// ServiceAccount is the email of the service account, if one is used.
+	ServiceAccount string
+	// Store is where the token is stored, for user credentials.
+	Store string
+	// Scopes are the scopes granted to the token.
+	Scopes []string
+	// Expiry is when the stored access token expires.
+	Expiry time.Time
+	// RefreshToken tells whether a refresh token is stored.
+	RefreshToken bool
+	// RefreshErr is why a new access token could not be obtained, if so.
+	RefreshErr error
+}
+
+// GetStatus inspects the credentials in use. It obtains a new access token,
+// to check that the stored refresh token still works, and saves it.
+func GetStatus(ctx context.Context) (*Status, error) {
+	status := &Status{}
+	var current *oauth2.Token
+
+	if UsesServiceAccount() {
+		config, err := serviceAccountConfig(options.ServiceAccount, Scopes)
+		if err != nil {
+			return nil, err
+		}
+		status.ServiceAccount = config.Email
+		status.Account = config.Subject
+		current, status.RefreshErr = config.TokenSource(ctx).Token()
+		if current != nil {
+			status.Expiry = current.Expiry
+		}
+	} else {
+		config, err := GetConfig(Scopes)
+		if err != nil {
+			return nil, err
+		}
+		store, err := TokenStoreInUse()
+		if err != nil {
+			return nil, err
+		}
+		status.Store = store.String()
+		tok, err := store.Load()
+		if errors.Is(err, ErrNoToken) {
+			return nil, fmt.Errorf("not authenticated: no token in %s. Please run 'auth'", store)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to load token from %s: %w", store, err)
+		}
+		status.Expiry = tok.Expiry
+		status.RefreshToken = tok.RefreshToken != ""
+
+		// Refresh even if the access token is still valid
+		expired := *tok
+		expired.Expiry = time.Now().Add(-time.Minute)
+		current, status.RefreshErr = config.TokenSource(ctx, &expired).Token()
+		if status.RefreshErr == nil {
+			if err := store.Save(current); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if status.RefreshErr != nil {
+		return status, nil
+	}
+
+	scopes, err := tokenScopes(ctx, current.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	status.Scopes = scopes
+
+	// The ID of the primary calendar is the email of the account
+	srv, err := calendar.NewService(ctx, option.WithTokenSource(oauth2.StaticTokenSource(current)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve Google Calendar service: %w", err)
+	}
+	primary, err := srv.CalendarList.Get("primary").Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the primary calendar: %w", err)
+	}
+	status.Account = primary.Id
+	return status, nil
+}
+
+// tokenScopes asks Google the scopes granted to the access token.
+func tokenScopes(ctx context.Context, accessToken string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenInfoURL+"?"+url.Values{"access_token": {accessToken}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token info: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to read token info: %s", resp.Status)
+	}
+	var info struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("unable to decode token info: %w", err)
+	}
+	return strings.Fields(info.Scope), nil
+}
+
+// Revoke revokes the authorization given to the application, and deletes
+// the stored token. A token Google no longer knows is deleted all the same.
+func Revoke(ctx context.Context) error {
+	if UsesServiceAccount() {
+		return fmt.Errorf("service account keys cannot be revoked from here: delete the key in the Google Cloud console")
+	}
+	store, err := TokenStoreInUse()
+	if err != nil {
+		return err
+	}
+	tok, err := store.Load()
+	if errors.Is(err, ErrNoToken) {
+		return fmt.Errorf("no token in %s, nothing to revoke", store)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to load token from %s: %w", store, err)
+	}
+
+	// Revoking the refresh token revokes the access tokens too
+	token := tok.RefreshToken
+	if token == "" {
+		token = tok.AccessToken
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, revokeURL, strings.NewReader(url.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to revoke the token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusBadRequest:
+		// invalid_token: already revoked or expired
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if body.Error != "invalid_token" {
+			return fmt.Errorf("unable to revoke the token: %s %s", resp.Status, body.Error)
+		}
+		fmt.Println("Google no longer knows the token: it was already revoked or expired.")
+	default:
+		return fmt.Errorf("unable to revoke the token: %s", resp.Status)
+	}
+
+	if err := store.Delete(); err != nil {
+		return fmt.Errorf("token revoked, but not deleted from %s: %w", store, err)
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/clobrano/TaskwarriorAgenda/internal/fsutil"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+// The backends the OAuth token can be stored with.
+const (
+	// StoreFile keeps the token as plain JSON, readable by the owner only.
+	StoreFile = "file"
+	// StoreEncrypted keeps the token in a file encrypted with a passphrase.
+	StoreEncrypted = "encrypted"
+	// StoreKeyring keeps the token in the Secret Service keyring (GNOME
+	// Keyring, KWallet...), through secret-tool.
+	StoreKeyring = "keyring"
+)
+
+const (
+	// EncryptedTokenFile is the default name of the encrypted token file.
+	EncryptedTokenFile = "token.json.enc"
+	// PassphraseEnv is the environment variable the passphrase of the
+	// encrypted token file is read from, when there is no passphrase command.
+	PassphraseEnv = "TASKWARRIOR_AGENDA_PASSPHRASE"
+	// defaultKeyringCommand is the command the keyring is accessed with.
+	defaultKeyringCommand = "secret-tool"
+)
+
+// ErrNoToken is returned by TokenStore.Load when no token is stored.
+var ErrNoToken = errors.New("no token stored")
+
+// TokenStore keeps the OAuth token between runs.
+type TokenStore interface {
+	// Load returns the stored token, or ErrNoToken.
+	Load() (*oauth2.Token, error)
+	// Save replaces the stored token.
+	Save(tok *oauth2.Token) error
+	// Delete removes the stored token, if any.
+	Delete() error
+	// String describes where the token is stored.
+	String() string
+}
+
+// StoreOptions select and configure the token store.
+type StoreOptions struct {
+	// Backend is StoreFile (the default), StoreEncrypted or StoreKeyring.
+	Backend string
+	// Path is the file of the file and encrypted backends. It defaults to
+	// TokenFile or EncryptedTokenFile in the configuration directory.
+	Path string
+	// PassphraseCommand prints the passphrase of the encrypted file (e.g.
+	// "pass show taskwarrior-agenda"). Without it, the passphrase is read
+	// from PassphraseEnv.
+	PassphraseCommand string
+	// KeyringCommand replaces secret-tool, e.g. with a compatible script.
+	KeyringCommand string
+}
+
+// NewTokenStore returns the token store selected by o.
+func NewTokenStore(o StoreOptions) (TokenStore, error) {
+	path := func(name string) (string, error) {
+		if o.Path != "" {
+			return o.Path, nil
+		}
+		xdgConfigBase, err := GetXdgHome()
+		if err != nil {
+			return "", fmt.Errorf("could not find path to configuration directory: %w", err)
+		}
+		return filepath.Join(xdgConfigBase, name), nil
+	}
+
+	switch o.Backend {
+	case "", StoreFile:
+		p, err := path(TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return &fileStore{path: p}, nil
+	case StoreEncrypted:
+		p, err := path(EncryptedTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return &encryptedStore{path: p, passphraseCommand: o.PassphraseCommand}, nil
+	case StoreKeyring:
+		command := o.KeyringCommand
+		if command == "" {
+			command = defaultKeyringCommand
+		}
+		return &keyringStore{command: command}, nil
+	default:
+		return nil, fmt.Errorf("invalid token store '%s'. Please use '%s', '%s' or '%s'", o.Backend, StoreFile, StoreEncrypted, StoreKeyring)
+	}
+}
+
+// TokenStoreInUse returns the token store selected with Configure.
+func TokenStoreInUse() (TokenStore, error) {
+	return NewTokenStore(options.Token)
+}
+
+// fileStore keeps the token as plain JSON.
+type fileStore struct {
+	path string
+}
+
+func (s *fileStore) Load() (*oauth2.Token, error) {
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeToken(b, s.path)
+}
+
+func (s *fileStore) Save(tok *oauth2.Token) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
+
+func (s *fileStore) Delete() error {
+	return removeFile(s.path)
+}
+
+func (s *fileStore) String() string {
+	return s.path
+}
+
+// encryptedStore keeps the token in a file encrypted with
+// XChaCha20-Poly1305, with a key derived from a passphrase with scrypt. The
+// file is the magic string, the scrypt salt, the nonce and the ciphertext.
+type encryptedStore struct {
+	path              string
+	passphraseCommand string
+	// passphrase is read once, and kept for the later saves
+	passphrase []byte
+}
+
+const (
+	encryptedMagic = "TWAGENDA-TOKEN-1\n"
+	saltSize       = 16
+	// scrypt parameters recommended for interactive logins
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+func (s *encryptedStore) Load() (*oauth2.Token, error) {
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header := len(encryptedMagic) + saltSize + chacha20poly1305.NonceSizeX
+	if len(b) < header || string(b[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, fmt.Errorf("%s is not an encrypted token file", s.path)
+	}
+	salt := b[len(encryptedMagic) : len(encryptedMagic)+saltSize]
+	nonce := b[len(encryptedMagic)+saltSize : header]
+
+	aead, err := s.cipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, nonce, b[header:], []byte(encryptedMagic))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt %s, is the passphrase right? %w", s.path, err)
+	}
+	return decodeToken(plain, s.path)
+}
+
+func (s *encryptedStore) Save(tok *oauth2.Token) error {
+	plain, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	// A new salt and nonce at every save
+	header := make([]byte, saltSize+chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(header); err != nil {
+		return fmt.Errorf("unable to generate the encryption nonce: %w", err)
+	}
+	salt, nonce := header[:saltSize], header[saltSize:]
+
+	aead, err := s.cipher(salt)
+	if err != nil {
+		return err
+	}
+	b := append([]byte(encryptedMagic), header...)
+	b = aead.Seal(b, nonce, plain, []byte(encryptedMagic))
+	return writeFileAtomic(s.path, b)
+}
+
+func (s *encryptedStore) Delete() error {
+	return removeFile(s.path)
+}
+
+func (s *encryptedStore) String() string {
+	return s.path + " (encrypted)"
+}
+
+// cipher derives the key from the passphrase and salt.
+func (s *encryptedStore) cipher(salt []byte) (cipher.AEAD, error) {
+	if s.passphrase == nil {
+		passphrase, err := s.readPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		s.passphrase = passphrase
+	}
+	key, err := scrypt.Key(s.passphrase, salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive the encryption key: %w", err)
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// readPassphrase runs the passphrase command, or reads PassphraseEnv.
+func (s *encryptedStore) readPassphrase() ([]byte, error) {
+	var passphrase string
+	if s.passphraseCommand != "" {
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", s.passphraseCommand)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("passphrase command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		passphrase = strings.TrimRight(string(out), "\r\n")
+	} else {
+		passphrase = os.Getenv(PassphraseEnv)
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("no passphrase for the encrypted token file: set auth.passphrase_command in config.yaml or %s", PassphraseEnv)
+	}
+	return []byte(passphrase), nil
+}
+
+// keyringStore keeps the token in the Secret Service keyring with
+// secret-tool, which talks to it over D-Bus.
+type keyringStore struct {
+	command string
+}
+
+// keyringAttributes identify the token in the keyring.
+var keyringAttributes = []string{"service", xdgAppName, "account", "oauth-token"}
+
+func (s *keyringStore) Load() (*oauth2.Token, error) {
+	out, err := s.run(nil, append([]string{"lookup"}, keyringAttributes...)...)
+	if err != nil {
+		// secret-tool fails without output when there is no such secret
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(out) == 0 {
+			return nil, ErrNoToken
+		}
+		return nil, err
+	}
+	return decodeToken(out, s.String())
+}
+
+func (s *keyringStore) Save(tok *oauth2.Token) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"store", "--label=TaskwarriorAgenda OAuth token"}, keyringAttributes...)
+	_, err = s.run(b, args...)
+	return err
+}
+
+func (s *keyringStore) Delete() error {
+	_, err := s.run(nil, append([]string{"clear"}, keyringAttributes...)...)
+	return err
+}
+
+func (s *keyringStore) String() string {
+	return "the system keyring"
+}
+
+// run runs the keyring command with the secret as input.
+func (s *keyringStore) run(secret []byte, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(s.command, args...)
+	cmd.Stdin = bytes.NewReader(secret)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return out, fmt.Errorf("%s %s failed: %w: %s", s.command, args[0], err, msg)
+		}
+		return out, fmt.Errorf("%s %s failed: %w", s.command, args[0], err)
+	}
+	return out, nil
+}
+
+// decodeToken parses a token stored as JSON.
+func decodeToken(b []byte, where string) (*oauth2.Token, error) {
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(b, tok); err != nil {
+		return nil, fmt.Errorf("failed to decode token from %s: %w", where, err)
+	}
+	return tok, nil
+}
+
+// writeFileAtomic writes the file readable by the owner only, so that it is
+// never left half written.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("could not create token directory %s: %w", dir, err)
+	}
+	if err := fsutil.WriteFileAtomic(path, data, 0600); err != nil {
+		return fmt.Errorf("unable to save token to %s: %w", path, err)
+	}
+	return nil
+}
+
+// removeFile removes the file, if it exists.
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func testToken() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  "access-secret",
+		RefreshToken: "refresh-secret",
+		TokenType:    "Bearer",
+		Expiry:       time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC),
+	}
+}
+
+// checkRoundTrip saves the token to the store and loads it back, then
+// deletes it.
+func checkRoundTrip(t *testing.T, store TokenStore) {
+	t.Helper()
+	if _, err := store.Load(); !errors.Is(err, ErrNoToken) {
+		t.Fatalf("got %v from an empty store, want ErrNoToken", err)
+	}
+	want := testToken()
+	if err := store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != want.AccessToken || got.RefreshToken != want.RefreshToken || !got.Expiry.Equal(want.Expiry) {
+		t.Errorf("got token %+v, want %+v", got, want)
+	}
+	if err := store.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); !errors.Is(err, ErrNoToken) {
+		t.Errorf("got %v after Delete, want ErrNoToken", err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config", TokenFile)
+	store, err := NewTokenStore(StoreOptions{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoundTrip(t, store)
+
+	if err := store.Save(testToken()); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("got token file mode %v, want 0600", info.Mode().Perm())
+	}
+}
+
+// fakeSecretTool is a stand-in for secret-tool, keeping the secret in a file
+// named after the attributes.
+const fakeSecretTool = `#!/bin/sh
+command=$1
+shift
+case "$1" in --label=*) shift ;; esac
+secret="$SECRETS/$(echo "$@" | tr ' ' _)"
+case "$command" in
+store) cat > "$secret" ;;
+lookup) [ -f "$secret" ] && cat "$secret" ;;
+clear) rm -f "$secret" ;;
+*) echo "unknown command $command" >&2; exit 2 ;;
+esac
+`
+
+func TestKeyringStore(t *testing.T) {
+	dir := t.TempDir()
+	command := filepath.Join(dir, "secret-tool")
+	if err := os.WriteFile(command, []byte(fakeSecretTool), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SECRETS", dir)
+
+	store, err := NewTokenStore(StoreOptions{Backend: StoreKeyring, KeyringCommand: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoundTrip(t, store)
+
+	// The token is stored under the attributes of this tool
+	if err := store.Save(testToken()); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(dir, strings.Join(keyringAttributes, "_"))
+	if _, err := os.Stat(secret); err != nil {
+		t.Errorf("token not stored with attributes %v: %v", keyringAttributes, err)
+	}
+
+	// Failures are reported with the command error output
+	failing := filepath.Join(dir, "failing")
+	if err := os.WriteFile(failing, []byte("#!/bin/sh\necho keyring locked >&2\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	store, _ = NewTokenStore(StoreOptions{Backend: StoreKeyring, KeyringCommand: failing})
+	if err := store.Save(testToken()); err == nil || !strings.Contains(err.Error(), "keyring locked") {
+		t.Errorf("got %v from a failing keyring, want its error output", err)
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), EncryptedTokenFile)
+	store, err := NewTokenStore(StoreOptions{Backend: StoreEncrypted, Path: path, PassphraseCommand: "echo right passphrase"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoundTrip(t, store)
+
+	if err := store.Save(testToken()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), encryptedMagic) || strings.Contains(string(b), "secret") {
+		t.Fatalf("token file is not encrypted: %q", b)
+	}
+
+	t.Run("passphrase from the environment", func(t *testing.T) {
+		t.Setenv(PassphraseEnv, "right passphrase")
+		store, _ := NewTokenStore(StoreOptions{Backend: StoreEncrypted, Path: path})
+		if tok, err := store.Load(); err != nil || tok.AccessToken != "access-secret" {
+			t.Errorf("got token %v and error %v", tok, err)
+		}
+	})
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		store, _ := NewTokenStore(StoreOptions{Backend: StoreEncrypted, Path: path, PassphraseCommand: "echo wrong"})
+		if _, err := store.Load(); err == nil || !strings.Contains(err.Error(), "passphrase") {
+			t.Errorf("got %v with a wrong passphrase, want a decryption error", err)
+		}
+	})
+
+	t.Run("no passphrase", func(t *testing.T) {
+		t.Setenv(PassphraseEnv, "")
+		store, _ := NewTokenStore(StoreOptions{Backend: StoreEncrypted, Path: path})
+		if _, err := store.Load(); err == nil || errors.Is(err, ErrNoToken) {
+			t.Errorf("got %v without passphrase, want an error", err)
+		}
+	})
+
+	for name, content := range map[string][]byte{
+		"truncated header": b[:len(encryptedMagic)+saltSize],
+		"plain token":      []byte(`{"access_token":"access-secret"}`),
+		"altered":          append(append([]byte{}, b[:len(b)-1]...), b[len(b)-1]^1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			bad := filepath.Join(t.TempDir(), EncryptedTokenFile)
+			if err := os.WriteFile(bad, content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			store, _ := NewTokenStore(StoreOptions{Backend: StoreEncrypted, Path: bad, PassphraseCommand: "echo right passphrase"})
+			if tok, err := store.Load(); err == nil || errors.Is(err, ErrNoToken) {
+				t.Errorf("got token %v and error %v, want an error", tok, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Event statuses
+const (
+	StatusConfirmed = "confirmed"
+	StatusCancelled = "cancelled"
+)
+
+var (
+	// ErrNotFound is returned when an event does not exist (anymore).
+	ErrNotFound = errors.New("event not found")
+	// ErrSyncTokenExpired is returned by ChangeReader.Changes when the
+	// token is no longer valid and all the events must be read again.
+	ErrSyncTokenExpired = errors.New("sync token expired")
+)
+
+// Event is a calendar event, independent of the calendar service.
+type Event struct {
+	// ID identifies the event in the backend calls, e.g. the Google event
+	// ID or the CalDAV resource path.
+	ID string `json:"id"`
+	// UID is the iCalendar UID of the event.
+	UID  string `json:"uid,omitempty"`
+	ETag string `json:"etag,omitempty"`
+
+	Summary     string `json:"summary,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Status is StatusConfirmed or StatusCancelled
+	Status string `json:"status,omitempty"`
+
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// AllDay events start and end at local midnight, the end being exclusive.
+	AllDay bool `json:"all_day,omitempty"`
+	// TimeZone is the IANA time zone recurring timed events are expanded in.
+	TimeZone string `json:"time_zone,omitempty"`
+	// Recurrence holds RRULE, RDATE and EXDATE lines, as in RFC 5545.
+	Recurrence []string `json:"recurrence,omitempty"`
+	// Color is the ID of the event color (see ColorID), empty for the
+	// color of the calendar.
+	Color string `json:"color,omitempty"`
+
+	// Properties are private key/value pairs, not shown in the calendar.
+	Properties map[string]string `json:"properties,omitempty"`
+	Updated    time.Time         `json:"updated"`
+}
+
+// Property returns the private property key of the event, if any.
+func (e *Event) Property(key string) string {
+	return e.Properties[key]
+}
+
+// Query selects the events returned by ListEvents.
+type Query struct {
+	// TimeMin, if not zero, skips the events ending before it.
+	TimeMin time.Time
+	// Properties, if not empty, selects the events having all of them.
+	Properties map[string]string
+	// Text, if not empty, selects the events containing it.
+	Text string
+}
+
+// CalendarBackend reads and writes the events of a calendar.
+type CalendarBackend interface {
+	// CalendarID identifies the calendar, e.g. in the state store.
+	CalendarID() string
+	ListEvents(ctx context.Context, query Query) ([]*Event, error)
+	GetEvent(ctx context.Context, id string) (*Event, error)
+	// InsertEvent creates the event and returns it as stored, ID included.
+	InsertEvent(ctx context.Context, event *Event) (*Event, error)
+	// UpdateEvent replaces the event with the same ID.
+	UpdateEvent(ctx context.Context, event *Event) (*Event, error)
+	DeleteEvent(ctx context.Context, id string) error
+}
+
+// Mutation kinds
+const (
+	OpInsert = "insert"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// Mutation is a change to apply to a calendar.
+type Mutation struct {
+	Op    string
+	Event *Event // the event to insert or update
+	ID    string // the event to delete
+}
+
+// Result is the outcome of a Mutation: the event as stored (nil for
+// deletions) or the error.
+type Result struct {
+	Event *Event
+	Err   error
+}
+
+// Batcher is implemented by the backends that can apply many mutations at
+// once, more efficiently than one by one.
+type Batcher interface {
+	// Apply returns the results in the order of the mutations.
+	Apply(ctx context.Context, mutations []Mutation) []Result
+}
+
+// ChangeReader is implemented by the backends that can return only the
+// events changed since a previous read.
+type ChangeReader interface {
+	// Changes returns the events changed since the read that returned
+	// syncToken, the deleted ones being StatusCancelled, and the token of
+	// the next read. An empty syncToken returns all the events.
+	Changes(ctx context.Context, syncToken string) (events []*Event, nextToken string, err error)
+}
+
+// InstanceLister is implemented by the backends that can return the
+// occurrences of recurring events, to update them one by one.
+type InstanceLister interface {
+	Instances(ctx context.Context, id string, timeMin, timeMax time.Time) ([]*Event, error)
+}
+
+// Mover is implemented by the backends that can move an event from another
+// calendar of the same account, keeping its ID.
+type Mover interface {
+	// MoveEvent moves the event with the given ID from the calendar with
+	// the given ID to the calendar of the backend.
+	MoveEvent(ctx context.Context, calendarID, id string) (*Event, error)
+}
+
+// Apply applies the mutations with the Batcher of the backend if any, or
+// one by one otherwise.
+func Apply(ctx context.Context, be CalendarBackend, mutations []Mutation) []Result {
+	if batcher, ok := be.(Batcher); ok {
+		return batcher.Apply(ctx, mutations)
+	}
+	results := make([]Result, len(mutations))
+	for i, m := range mutations {
+		switch m.Op {
+		case OpInsert:
+			results[i].Event, results[i].Err = be.InsertEvent(ctx, m.Event)
+		case OpUpdate:
+			results[i].Event, results[i].Err = be.UpdateEvent(ctx, m.Event)
+		case OpDelete:
+			results[i].Err = be.DeleteEvent(ctx, m.ID)
+		}
+	}
+	return results
+}
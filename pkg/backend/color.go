@@ -0,0 +1,55 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+)
+
+// color is an event color of Google Calendar, with the closest CSS color
+// name, used by the iCalendar COLOR property (RFC 7986).
+type color struct {
+	id   string
+	name string
+	css  string
+}
+
+var colors = []color{
+	{"1", "lavender", "lavender"},
+	{"2", "sage", "darkseagreen"},
+	{"3", "grape", "mediumorchid"},
+	{"4", "flamingo", "lightcoral"},
+	{"5", "banana", "gold"},
+	{"6", "tangerine", "darkorange"},
+	{"7", "peacock", "deepskyblue"},
+	{"8", "graphite", "gray"},
+	{"9", "blueberry", "royalblue"},
+	{"10", "basil", "seagreen"},
+	{"11", "tomato", "red"},
+}
+
+// ColorID returns the ID of the event color with the given ID, Google
+// Calendar name (e.g. "tomato") or CSS name (e.g. "red").
+func ColorID(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, c := range colors {
+		if name == c.id || name == c.name || name == c.css {
+			return c.id, nil
+		}
+	}
+	names := make([]string, 0, len(colors))
+	for _, c := range colors {
+		names = append(names, c.name)
+	}
+	return "", fmt.Errorf("unknown color '%s', available colors: %s", name, strings.Join(names, ", "))
+}
+
+// CSSColor returns the CSS name of the color with the given ID, or an empty
+// string if there is no such color.
+func CSSColor(id string) string {
+	for _, c := range colors {
+		if id == c.id {
+			return c.css
+		}
+	}
+	return ""
+}
@@ -0,0 +1,311 @@
+// Package caldav implements backend.CalendarBackend for CalDAV (RFC 4791)
+// servers, e.g. Nextcloud or Radicale.
+package caldav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/ical"
+	"github.com/google/uuid"
+)
+
+const (
+	calendarQuery = `<?xml version="1.0" encoding="utf-8"?>
+<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <d:prop><d:getetag/><c:calendar-data/></d:prop>
+  <c:filter><c:comp-filter name="VCALENDAR"><c:comp-filter name="VEVENT"/></c:comp-filter></c:filter>
+</c:calendar-query>`
+
+	syncCollection = `<?xml version="1.0" encoding="utf-8"?>
+<d:sync-collection xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <d:sync-token>%s</d:sync-token>
+  <d:sync-level>1</d:sync-level>
+  <d:prop><d:getetag/><c:calendar-data/></d:prop>
+</d:sync-collection>`
+
+	// requestTimeout bounds every request, so that an unresponsive server
+	// cannot hang a sync.
+	requestTimeout = 30 * time.Second
+)
+
+// Client is a CalDAV calendar collection.
+type Client struct {
+	collection *url.URL
+	username   string
+	password   string
+	httpClient *http.Client
+}
+
+// NewClient creates a client for the calendar collection at collectionURL,
+// e.g. https://cloud.example.com/remote.php/dav/calendars/me/tasks/, using
+// HTTP basic authentication when username is not empty.
+func NewClient(collectionURL, username, password string) (*Client, error) {
+	u, err := url.Parse(collectionURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid CalDAV calendar URL '%s'", collectionURL)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &Client{collection: u, username: username, password: password, httpClient: &http.Client{Timeout: requestTimeout}}, nil
+}
+
+// CalendarID returns the URL of the calendar collection.
+func (c *Client) CalendarID() string {
+	return c.collection.String()
+}
+
+// ListEvents returns the events of the calendar selected by the query. The
+// whole calendar is read, the query is applied locally.
+func (c *Client) ListEvents(ctx context.Context, query backend.Query) ([]*backend.Event, error) {
+	ms, err := c.report(ctx, calendarQuery, "1")
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*backend.Event
+	for _, resp := range ms.Responses {
+		event, err := resp.event()
+		if err != nil {
+			return nil, err
+		}
+		if event != nil && matches(event, query) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// matches reports whether the event is selected by the query.
+func matches(event *backend.Event, query backend.Query) bool {
+	if !query.TimeMin.IsZero() && len(event.Recurrence) == 0 && event.End.Before(query.TimeMin) {
+		return false
+	}
+	for key, value := range query.Properties {
+		if event.Property(key) != value {
+			return false
+		}
+	}
+	if query.Text != "" && !strings.Contains(event.Summary, query.Text) && !strings.Contains(event.Description, query.Text) {
+		return false
+	}
+	return true
+}
+
+// GetEvent fetches the event stored at the path id.
+func (c *Client) GetEvent(ctx context.Context, id string) (*backend.Event, error) {
+	resp, err := c.do(ctx, http.MethodGet, id, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeEvent(id, resp.Header.Get("ETag"), data)
+}
+
+// InsertEvent stores a new event in the collection, named after a new UID.
+func (c *Client) InsertEvent(ctx context.Context, event *backend.Event) (*backend.Event, error) {
+	created := *event
+	created.UID = uuid.NewString()
+	created.ID = c.collection.Path + created.UID + ".ics"
+	return c.put(ctx, &created, map[string]string{"If-None-Match": "*"})
+}
+
+// UpdateEvent replaces the event stored at event.ID.
+func (c *Client) UpdateEvent(ctx context.Context, event *backend.Event) (*backend.Event, error) {
+	updated := *event
+	if updated.UID == "" {
+		// The UID of an event cannot change
+		current, err := c.GetEvent(ctx, event.ID)
+		if err != nil {
+			return nil, err
+		}
+		updated.UID = current.UID
+	}
+	return c.put(ctx, &updated, nil)
+}
+
+// DeleteEvent deletes the event stored at the path id.
+func (c *Client) DeleteEvent(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, http.MethodDelete, id, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// Changes implements backend.ChangeReader with a sync-collection report
+// (RFC 6578). Servers not supporting it are read in full every time.
+func (c *Client) Changes(ctx context.Context, syncToken string) ([]*backend.Event, string, error) {
+	// The scope of sync-collection is given by sync-level, Depth must be 0
+	ms, err := c.report(ctx, fmt.Sprintf(syncCollection, xmlEscape(syncToken)), "0")
+	if err != nil {
+		var httpErr *httpError
+		switch {
+		case syncToken != "" && errors.As(err, &httpErr) && (httpErr.code == http.StatusForbidden || httpErr.code == http.StatusConflict):
+			// The valid-sync-token precondition failed
+			return nil, "", backend.ErrSyncTokenExpired
+		case syncToken == "":
+			events, err := c.ListEvents(ctx, backend.Query{})
+			return events, "", err
+		}
+		return nil, "", err
+	}
+
+	var events []*backend.Event
+	for _, resp := range ms.Responses {
+		if resp.removed() {
+			events = append(events, &backend.Event{ID: resp.path(), Status: backend.StatusCancelled})
+			continue
+		}
+		event, err := resp.event()
+		if err != nil {
+			return nil, "", err
+		}
+		if event != nil {
+			events = append(events, event)
+		}
+	}
+	return events, ms.SyncToken, nil
+}
+
+// put stores the event and returns it with its new ETag.
+func (c *Client) put(ctx context.Context, event *backend.Event, headers map[string]string) (*backend.Event, error) {
+	cal := ical.NewCalendar()
+	cal.Components = append(cal.Components, ical.EventToComponent(event))
+	var body bytes.Buffer
+	if err := ical.Encode(&body, cal); err != nil {
+		return nil, err
+	}
+
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers["Content-Type"] = "text/calendar; charset=utf-8"
+	resp, err := c.do(ctx, http.MethodPut, event.ID, &body, headers)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	stored := *event
+	stored.ETag = resp.Header.Get("ETag")
+	if stored.ETag == "" {
+		// Servers changing the event on save do not return the ETag
+		return c.GetEvent(ctx, event.ID)
+	}
+	return &stored, nil
+}
+
+// report sends a REPORT request to the collection, with the Depth header
+// the report requires.
+func (c *Client) report(ctx context.Context, body, depth string) (*multistatus, error) {
+	resp, err := c.do(ctx, "REPORT", c.collection.Path, strings.NewReader(body), map[string]string{
+		"Content-Type": "application/xml; charset=utf-8",
+		"Depth":        depth,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	ms := &multistatus{}
+	if err := xml.NewDecoder(resp.Body).Decode(ms); err != nil {
+		return nil, fmt.Errorf("unable to parse CalDAV response: %w", err)
+	}
+	return ms, nil
+}
+
+// do sends a request for the resource at path, relative to the server.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	ref := &url.URL{Path: path}
+	req, err := http.NewRequestWithContext(ctx, method, c.collection.ResolveReference(ref).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return c.httpClient.Do(req)
+}
+
+// decodeEvent returns the first event of the calendar data stored at id.
+func decodeEvent(id, etag string, data []byte) (*backend.Event, error) {
+	cal, err := ical.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse event %s: %w", id, err)
+	}
+	vevents := cal.Children("VEVENT")
+	if len(vevents) == 0 {
+		return nil, nil
+	}
+	// Overridden occurrences share the UID: the master has no RECURRENCE-ID
+	master := vevents[0]
+	for _, vevent := range vevents {
+		if vevent.Get("RECURRENCE-ID") == nil {
+			master = vevent
+			break
+		}
+	}
+	event, err := ical.EventFromComponent(master)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse event %s: %w", id, err)
+	}
+	event.ID = id
+	event.ETag = etag
+	return event, nil
+}
+
+// httpError is an unexpected HTTP response.
+type httpError struct {
+	code   int
+	status string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("CalDAV request failed: %s", e.status)
+}
+
+// checkResponse returns backend.ErrNotFound for missing resources, and an
+// error for any other non successful response.
+func checkResponse(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return backend.ErrNotFound
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return &httpError{code: resp.StatusCode, status: resp.Status}
+	}
+	return nil
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,318 @@
+package caldav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+)
+
+const collectionPath = "/calendars/me/tasks/"
+
+// resource is an event stored by fakeServer. Deleted resources are kept as
+// tombstones, for the sync-collection reports.
+type resource struct {
+	etag    string
+	data    string
+	version int
+	deleted bool
+}
+
+// fakeServer is a strict CalDAV server keeping a single collection in
+// memory. Sync tokens are the version of the collection when they were
+// given.
+type fakeServer struct {
+	mu        sync.Mutex
+	resources map[string]*resource
+	version   int
+	// omitETag makes PUT answer without ETag, as servers changing the
+	// event on save do.
+	omitETag bool
+}
+
+var syncTokenRe = regexp.MustCompile(`<d:sync-token>(.*)</d:sync-token>`)
+
+func newFakeServer(t *testing.T) (*fakeServer, *Client) {
+	f := &fakeServer{resources: make(map[string]*resource)}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	client, err := NewClient(server.URL+collectionPath, "me", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, client
+}
+
+// store adds or replaces a resource, returning its new ETag.
+func (f *fakeServer) store(path, data string) string {
+	f.version++
+	etag := fmt.Sprintf(`"etag-%d"`, f.version)
+	f.resources[path] = &resource{etag: etag, data: data, version: f.version}
+	return etag
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if user, password, ok := r.BasicAuth(); !ok || user != "me" || password != "secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	res := f.resources[r.URL.Path]
+	if res != nil && res.deleted {
+		res = nil
+	}
+
+	switch r.Method {
+	case "REPORT":
+		f.report(w, r)
+	case http.MethodGet:
+		if res == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", res.etag)
+		io.WriteString(w, res.data)
+	case http.MethodPut:
+		if r.Header.Get("If-None-Match") == "*" && res != nil {
+			http.Error(w, "exists", http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		etag := f.store(r.URL.Path, string(body))
+		if !f.omitETag {
+			w.Header().Set("ETag", etag)
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if res == nil {
+			http.NotFound(w, r)
+			return
+		}
+		f.version++
+		f.resources[r.URL.Path] = &resource{version: f.version, deleted: true}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeServer) report(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	syncReport := strings.Contains(string(body), "sync-collection")
+	// RFC 6578 §3.2: sync-collection must be sent with Depth 0
+	if wantDepth := map[bool]string{true: "0", false: "1"}[syncReport]; r.Header.Get("Depth") != wantDepth {
+		http.Error(w, "bad depth", http.StatusBadRequest)
+		return
+	}
+
+	since := 0
+	if syncReport {
+		if m := syncTokenRe.FindStringSubmatch(string(body)); m != nil && m[1] != "" {
+			var err error
+			if since, err = strconv.Atoi(m[1]); err != nil || since > f.version {
+				http.Error(w, `<d:error xmlns:d="DAV:"><d:valid-sync-token/></d:error>`, http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(f.resources))
+	for path := range f.resources {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?><d:multistatus xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">`)
+	for _, path := range paths {
+		res := f.resources[path]
+		switch {
+		case res.version <= since || (res.deleted && !syncReport):
+		case res.deleted:
+			fmt.Fprintf(&b, `<d:response><d:href>%s</d:href><d:status>HTTP/1.1 404 Not Found</d:status></d:response>`, path)
+		default:
+			var data strings.Builder
+			xml.EscapeText(&data, []byte(res.data))
+			fmt.Fprintf(&b, `<d:response><d:href>%s</d:href><d:propstat><d:prop><d:getetag>%s</d:getetag><c:calendar-data>%s</c:calendar-data></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`, path, res.etag, data.String())
+		}
+	}
+	if syncReport {
+		fmt.Fprintf(&b, `<d:sync-token>%d</d:sync-token>`, f.version)
+	}
+	b.WriteString(`</d:multistatus>`)
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, b.String())
+}
+
+func newEvent(summary string, start time.Time) *backend.Event {
+	return &backend.Event{
+		Summary:    summary,
+		Start:      start,
+		End:        start.Add(time.Hour),
+		Properties: map[string]string{"taskwarrioragenda-id": summary},
+	}
+}
+
+func TestInsertGetUpdateDelete(t *testing.T) {
+	_, client := newFakeServer(t)
+	ctx := context.Background()
+	start := time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)
+
+	created, err := client.InsertEvent(ctx, newEvent("write report", start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.ID, collectionPath) || created.UID == "" || created.ETag == "" {
+		t.Fatalf("got created event %+v, want ID in the collection, UID and ETag", created)
+	}
+
+	got, err := client.GetEvent(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Summary != "write report" || !got.Start.Equal(start) || got.ETag != created.ETag || got.Property("taskwarrioragenda-id") != "write report" {
+		t.Errorf("got event %+v, want the created one", got)
+	}
+
+	got.Summary = "write the report"
+	got.UID = ""
+	updated, err := client.UpdateEvent(ctx, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ETag == created.ETag || updated.UID != created.UID {
+		t.Errorf("got updated event %+v, want a new ETag and the same UID", updated)
+	}
+
+	if err := client.DeleteEvent(ctx, created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetEvent(ctx, created.ID); !errors.Is(err, backend.ErrNotFound) {
+		t.Errorf("got %v reading a deleted event, want ErrNotFound", err)
+	}
+	if err := client.DeleteEvent(ctx, created.ID); !errors.Is(err, backend.ErrNotFound) {
+		t.Errorf("got %v deleting a deleted event, want ErrNotFound", err)
+	}
+}
+
+func TestPutWithoutETag(t *testing.T) {
+	server, client := newFakeServer(t)
+	server.omitETag = true
+
+	created, err := client.InsertEvent(context.Background(), newEvent("call", time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The ETag is read back with a GET
+	if created.ETag != server.resources[created.ID].etag {
+		t.Errorf("got ETag %q, want %q", created.ETag, server.resources[created.ID].etag)
+	}
+}
+
+func TestListEvents(t *testing.T) {
+	_, client := newFakeServer(t)
+	ctx := context.Background()
+	old := time.Date(2025, 1, 1, 9, 0, 0, 0, time.UTC)
+	recent := time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)
+	for _, event := range []*backend.Event{newEvent("old", old), newEvent("recent", recent)} {
+		if _, err := client.InsertEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := client.ListEvents(ctx, backend.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	for _, event := range events {
+		if event.ETag == "" || !strings.HasPrefix(event.ID, collectionPath) {
+			t.Errorf("got event %+v, want its path and ETag", event)
+		}
+	}
+
+	events, err = client.ListEvents(ctx, backend.Query{TimeMin: recent.Add(-24 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Summary != "recent" {
+		t.Errorf("got %v, want only the recent event", events)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	_, client := newFakeServer(t)
+	ctx := context.Background()
+	start := time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)
+
+	kept, err := client.InsertEvent(ctx, newEvent("kept", start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := client.InsertEvent(ctx, newEvent("removed", start))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, token, err := client.Changes(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || token == "" {
+		t.Fatalf("got %d events and token %q on the first read, want 2 events and a token", len(events), token)
+	}
+
+	// No changes
+	events, token2, err := client.Changes(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 || token2 != token {
+		t.Fatalf("got %d events and token %q without changes, want none and %q", len(events), token2, token)
+	}
+
+	kept.Summary = "kept and changed"
+	if _, err := client.UpdateEvent(ctx, kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeleteEvent(ctx, removed.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	events, token3, err := client.Changes(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token3 == token {
+		t.Error("sync token not advanced after changes")
+	}
+	got := make(map[string]*backend.Event)
+	for _, event := range events {
+		got[event.ID] = event
+	}
+	if len(got) != 2 || got[kept.ID].Summary != "kept and changed" || got[removed.ID].Status != backend.StatusCancelled {
+		t.Errorf("got changes %v, want the updated and the cancelled event", events)
+	}
+
+	if _, _, err := client.Changes(ctx, "999"); !errors.Is(err, backend.ErrSyncTokenExpired) {
+		t.Errorf("got %v with an unknown token, want ErrSyncTokenExpired", err)
+	}
+}
@@ -0,0 +1,54 @@
+package caldav
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+)
+
+// multistatus is the WebDAV response to REPORT requests.
+type multistatus struct {
+	Responses []response `xml:"DAV: response"`
+	SyncToken string     `xml:"DAV: sync-token"`
+}
+
+type response struct {
+	Href      string     `xml:"DAV: href"`
+	Status    string     `xml:"DAV: status"`
+	Propstats []propstat `xml:"DAV: propstat"`
+}
+
+type propstat struct {
+	Status string `xml:"DAV: status"`
+	Prop   struct {
+		ETag         string `xml:"DAV: getetag"`
+		CalendarData string `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+	} `xml:"DAV: prop"`
+}
+
+// path returns the decoded path of the resource.
+func (r *response) path() string {
+	if u, err := url.Parse(r.Href); err == nil {
+		return u.Path
+	}
+	return r.Href
+}
+
+// removed reports whether the response tells that the resource was deleted,
+// in sync-collection reports.
+func (r *response) removed() bool {
+	return strings.Contains(r.Status, " 404")
+}
+
+// event returns the event of the response, or nil for resources that are
+// not events (e.g. the collection itself).
+func (r *response) event() (*backend.Event, error) {
+	for _, ps := range r.Propstats {
+		if !strings.Contains(ps.Status, " 200") || ps.Prop.CalendarData == "" {
+			continue
+		}
+		return decodeEvent(r.path(), ps.Prop.ETag, []byte(ps.Prop.CalendarData))
+	}
+	return nil, nil
+}
@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+)
+
+// ensureEvents loads the calendar events once per engine. When they cannot
+// be loaded, the events are searched on the calendar for each task instead.
+func (e *Engine) ensureEvents() {
+	if e.eventsLoaded {
+		return
+	}
+	e.eventsLoaded = true
+
+	reader, ok := e.backend.(backend.ChangeReader)
+	if !ok {
+		return
+	}
+	if err := e.loadEvents(reader); err != nil {
+		log.Printf("Error reading the calendar events, searching them one by one: %v", err)
+		e.events = nil
+	}
+}
+
+// loadEvents brings the local copy of the calendar events up to date. The
+// first run reads the whole calendar, the next ones only the events changed
+// since, using the sync token saved in the state store. When the backend
+// rejects the token, the calendar is read again in full.
+func (e *Engine) loadEvents(reader backend.ChangeReader) error {
+	token, cached := e.store.Cache(e.calendarID)
+	events := make(map[string]*backend.Event, len(cached))
+	for id, raw := range cached {
+		event := &backend.Event{}
+		if err := json.Unmarshal(raw, event); err != nil || event.ID == "" {
+			// A cache that cannot be trusted, e.g. written by an older
+			// version, is thrown away
+			log.Printf("Ignoring unreadable cached event %s, reading all the events again", id)
+			token = ""
+			break
+		}
+		events[id] = event
+	}
+	if token == "" {
+		// Events cached without a token may be stale: read them all again
+		events = make(map[string]*backend.Event)
+	}
+
+	changed, nextToken, err := reader.Changes(context.Background(), token)
+	if errors.Is(err, backend.ErrSyncTokenExpired) && token != "" {
+		log.Printf("Calendar sync token expired, reading all the events again")
+		e.store.ResetCache(e.calendarID)
+		return e.loadEvents(reader)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to retrieve events from calendar: %w", err)
+	}
+	for _, event := range changed {
+		events[event.ID] = event
+	}
+
+	if token == "" {
+		log.Printf("Read %d events from the calendar", len(changed))
+	} else {
+		log.Printf("Read %d changed events from the calendar", len(changed))
+	}
+
+	e.store.ResetCache(e.calendarID)
+	e.events = make(map[string]*backend.Event, len(events))
+	for _, event := range events {
+		e.cacheEvent(event)
+	}
+	e.store.SetSyncToken(e.calendarID, nextToken)
+	return nil
+}
+
+// cacheEvent records the latest known version of an event, both in memory
+// and in the state store.
+func (e *Engine) cacheEvent(event *backend.Event) {
+	if e.events == nil || event == nil || event.ID == "" {
+		return
+	}
+	raw, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error caching event %s: %v", event.ID, err)
+		return
+	}
+	e.events[event.ID] = event
+	e.store.PutEvent(e.calendarID, event.ID, raw)
+}
+
+// forgetEvent removes a deleted event from the cache.
+func (e *Engine) forgetEvent(eventID string) {
+	if e.events == nil {
+		return
+	}
+	delete(e.events, eventID)
+	e.store.PutEvent(e.calendarID, eventID, nil)
+}
+
+// cachedEvent returns the cached event with the given ID, unless it was
+// deleted from the calendar.
+func (e *Engine) cachedEvent(eventID string) (*backend.Event, bool) {
+	event, ok := e.events[eventID]
+	if !ok || event.Status == backend.StatusCancelled {
+		return nil, false
+	}
+	return event, true
+}
+
+// searchCache returns the cached event linked to the task, looking at the
+// private properties first and at the legacy description text next.
+func (e *Engine) searchCache(taskID string) *backend.Event {
+	var legacy *backend.Event
+	for _, event := range e.events {
+		if event.Status == backend.StatusCancelled {
+			continue
+		}
+		if event.Property(util.PropertyTaskID) == taskID {
+			return event
+		}
+		if id, found := util.GetTaskIDFromEventDescription(event.Description); found && id == taskID {
+			legacy = event
+		}
+	}
+	return legacy
+}
@@ -0,0 +1,500 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/state"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+)
+
+const (
+	// ConflictTaskWins keeps the task value when both sides changed a field.
+	ConflictTaskWins = "task"
+	// ConflictCalendarWins keeps the calendar value when both sides changed a field.
+	ConflictCalendarWins = "calendar"
+)
+
+// Engine syncs tasks to the events of a calendar backend.
+type Engine struct {
+	backend    backend.CalendarBackend
+	calendarID string
+	store      *state.Store
+
+	// events is the local copy of the calendar events, by ID, or nil when
+	// the backend cannot read changes or the events could not be loaded
+	events       map[string]*backend.Event
+	eventsLoaded bool
+
+	// pending mutations, applied by Flush, and the outcomes of the tasks
+	// synced so far
+	pending  []*operation
+	outcomes []Outcome
+
+	// writer, conflicts and timing are set only in two-way mode
+	writer    model.Writer
+	conflicts map[string]string
+	timing    util.TimingRules
+
+	// dryRun plans the changes without making them
+	dryRun bool
+}
+
+// New creates a sync engine for the calendar of the backend.
+// The store keeps track of the events created for each task, so that they can
+// be fetched directly instead of searching the whole calendar.
+func New(be backend.CalendarBackend, store *state.Store) *Engine {
+	return &Engine{backend: be, calendarID: be.CalendarID(), store: store}
+}
+
+// EnableTwoWay makes SyncEvent apply the changes made on the calendar since
+// the last sync back to the task, through the given writer. The conflicts map
+// tells, per field (due, status, description), which side wins when both the
+// task and the event changed. Unless told otherwise, the task wins. The timing
+// rules the events were placed with tell which task dates moving or resizing
+// an event changes.
+func (e *Engine) EnableTwoWay(writer model.Writer, conflicts map[string]string, timing util.TimingRules) {
+	e.writer = writer
+	e.conflicts = conflicts
+	e.timing = timing
+}
+
+// SetDryRun makes the engine only plan the changes: Flush reports what would
+// be created, updated or deleted, with the changed fields, and neither the
+// calendar nor the tasks are modified. The state store must not be saved.
+func (e *Engine) SetDryRun(dryRun bool) {
+	e.dryRun = dryRun
+}
+
+// SyncEvent plans the creation or the update of the task event. The changes
+// are queued and applied by Flush, which reports the outcome of the task.
+// Errors found while planning are returned, and reported by Flush too.
+func (e *Engine) SyncEvent(task model.Task) error {
+	fail := func(action string, err error) error {
+		e.record(task.ID, task.Description, action, err)
+		return err
+	}
+
+	event, err := util.ConvertTaskToCalendarEvent(&task)
+	if err != nil {
+		return fail(ActionSkip, err)
+	}
+	hash := util.TaskHash(&task)
+
+	e.ensureEvents()
+	if m, ok := e.store.Get(task.ID); ok && m.CalendarID != "" && m.CalendarID != e.calendarID {
+		// The task is now routed to this calendar
+		if e.dryRun {
+			e.enqueue(&operation{
+				taskID: task.ID, description: task.Description, action: ActionMove,
+				reason: fmt.Sprintf("from calendar %s", m.CalendarID),
+			})
+			return nil
+		}
+		if err := e.moveEvent(task, m); err != nil {
+			return fail(ActionUpdate, err)
+		}
+	}
+
+	existingEvent, upToDate, err := e.findEvent(task, hash)
+	if err != nil {
+		return fail(ActionUpdate, err)
+	}
+	if upToDate {
+		log.Printf("Event for task %s is already up to date", task.Description)
+		e.record(task.ID, task.Description, ActionSkip, nil)
+		return nil
+	}
+
+	// Calendar-side edits of recurring events are not written back: they
+	// would have to be told apart from the edits of single occurrences.
+	if existingEvent != nil && e.writer != nil && len(task.Recurrence) == 0 {
+		// Only events linked in the store have a known last-synced state to
+		// tell which side changed.
+		if m, ok := e.store.Get(task.ID); ok && m.EventID == existingEvent.ID && m.ETag != existingEvent.ETag {
+			task, err = e.pullChanges(task, existingEvent, m.Hash != hash)
+			if err != nil {
+				return fail(ActionUpdate, fmt.Errorf("unable to write calendar changes back to task: %w", err))
+			}
+
+			if existingEvent.Status == backend.StatusCancelled {
+				if task.Status == "deleted" {
+					log.Printf("Event for task %s was deleted from the calendar", task.Description)
+					e.store.Delete(task.ID)
+					e.record(task.ID, task.Description, ActionSkip, nil)
+					return nil
+				}
+				if existingEvent.ETag == "" {
+					// The event is gone for good: create it again
+					e.store.Delete(task.ID)
+					existingEvent = nil
+				}
+			}
+
+			if event, err = util.ConvertTaskToCalendarEvent(&task); err != nil {
+				return fail(ActionUpdate, err)
+			}
+			hash = util.TaskHash(&task)
+		}
+	}
+
+	// done links the written event to the task once the mutation is applied
+	done := func(written *backend.Event, err error) error {
+		if err != nil {
+			return err
+		}
+		e.cacheEvent(written)
+		e.markCompletedInstances(task, written)
+		e.remember(task, written, hash)
+		return nil
+	}
+
+	if existingEvent == nil {
+		log.Printf("Creating new event for task: %s", task.Description)
+		op := &operation{
+			taskID: task.ID, description: task.Description, action: ActionCreate,
+			mutation: backend.Mutation{Op: backend.OpInsert, Event: event}, done: done,
+		}
+		if e.dryRun {
+			op.changes, _ = util.EventDiff(&task, nil)
+		}
+		e.enqueue(op)
+		return nil
+	}
+
+	needsUpdate, reason, err := util.EventNeedsUpdate(&task, existingEvent)
+	if err != nil {
+		log.Printf("could not compare task with its calendar event, forcing update: %v", err)
+		needsUpdate = true
+	}
+	if !needsUpdate {
+		log.Printf("Event for task %s is already up to date", task.Description)
+		e.remember(task, existingEvent, hash)
+		e.record(task.ID, task.Description, ActionSkip, nil)
+		return nil
+	}
+
+	log.Printf("Updating event for task: %s", task.Description)
+	event.ID = existingEvent.ID
+	event.UID = existingEvent.UID
+	op := &operation{
+		taskID: task.ID, description: task.Description, action: ActionUpdate, reason: reason,
+		mutation: backend.Mutation{Op: backend.OpUpdate, Event: event}, done: done,
+	}
+	if e.dryRun {
+		op.changes, _ = util.EventDiff(&task, existingEvent)
+	}
+	e.enqueue(op)
+	return nil
+}
+
+// findEvent returns the calendar event linked to the task. The state store is
+// used first, and the calendar is searched only when no mapping is known.
+// When the stored ETag and hash show that neither the task nor the event
+// changed since the last sync, upToDate is true and no comparison is needed.
+// The local copy of the calendar events is used when available, so that no
+// request is needed at all.
+func (e *Engine) findEvent(task model.Task, hash string) (event *backend.Event, upToDate bool, err error) {
+	ctx := context.Background()
+	if m, ok := e.store.Get(task.ID); ok && m.CalendarID == e.calendarID {
+		event, ok := e.cachedEvent(m.EventID)
+		if !ok {
+			// Deleted or unknown events are fetched to tell them apart
+			event, err = e.backend.GetEvent(ctx, m.EventID)
+		}
+		switch {
+		case err == nil && m.ETag != "" && m.ETag == event.ETag && m.Hash == hash:
+			m.LastSynced = time.Now()
+			m.OrphanedSince = nil
+			e.store.Put(m)
+			return event, true, nil
+		case errors.Is(err, backend.ErrNotFound) && e.writer != nil:
+			// Let the two-way sync decide whether the task must be deleted
+			// too. The empty ETag marks the event as gone for good.
+			gone, err := util.ConvertTaskToCalendarEvent(&task)
+			if err != nil {
+				return nil, false, err
+			}
+			gone.ID = m.EventID
+			gone.Status = backend.StatusCancelled
+			return gone, false, nil
+		case errors.Is(err, backend.ErrNotFound):
+			log.Printf("Event %s for task %s no longer exists, searching the calendar", m.EventID, task.Description)
+			e.store.Delete(task.ID)
+		case err != nil:
+			return nil, false, fmt.Errorf("unable to retrieve event %s: %w", m.EventID, err)
+		default:
+			return event, false, nil
+		}
+	}
+
+	// No usable mapping: look for an event tagged with the task ID, e.g. one
+	// created before the state store existed.
+	if e.events != nil {
+		if cached := e.searchCache(task.ID); cached != nil {
+			log.Printf("Found existing event for task: %s", task.Description)
+			return cached, false, nil
+		}
+		return nil, false, nil
+	}
+	events, err := e.backend.ListEvents(ctx, backend.Query{Properties: map[string]string{util.PropertyTaskID: task.ID}})
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to retrieve events from calendar: %w", err)
+	}
+	if len(events) > 0 {
+		return events[0], false, nil
+	}
+
+	// Events created by older versions only carry the task ID in the
+	// description. Return them, so that they get migrated by the update.
+	legacy, err := e.backend.ListEvents(ctx, backend.Query{Text: task.ID})
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to retrieve events from calendar: %w", err)
+	}
+	for _, existingEvent := range legacy {
+		if id, found := util.GetTaskIDFromEventDescription(existingEvent.Description); found && id == task.ID {
+			log.Printf("Migrating legacy event for task: %s", task.Description)
+			return existingEvent, false, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// moveEvent moves the event of the task from the calendar it is linked to in
+// the store to the calendar of the engine. When the backend cannot move
+// events, or the event no longer exists, the link is dropped and the event
+// is searched for, or created, on this calendar.
+func (e *Engine) moveEvent(task model.Task, m state.Mapping) error {
+	mover, ok := e.backend.(backend.Mover)
+	if !ok {
+		log.Printf("Event for task %s cannot be moved from calendar %s, creating it again", task.Description, m.CalendarID)
+		e.store.Delete(task.ID)
+		return nil
+	}
+
+	moved, err := mover.MoveEvent(context.Background(), m.CalendarID, m.EventID)
+	if errors.Is(err, backend.ErrNotFound) {
+		log.Printf("Event %s for task %s no longer exists in calendar %s", m.EventID, task.Description, m.CalendarID)
+		e.store.Delete(task.ID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to move event %s from calendar %s: %w", m.EventID, m.CalendarID, err)
+	}
+
+	log.Printf("Moved event for task %s from calendar %s", task.Description, m.CalendarID)
+	e.cacheEvent(moved)
+	m.CalendarID = e.calendarID
+	m.EventID = moved.ID
+	m.ETag = moved.ETag
+	e.store.Put(m)
+	return nil
+}
+
+// markCompletedInstances queues the addition of the completed prefix to the
+// occurrences of a recurring event that were completed, as exceptions of the
+// recurrence. Backends that cannot list the occurrences are skipped.
+func (e *Engine) markCompletedInstances(task model.Task, event *backend.Event) {
+	lister, ok := e.backend.(backend.InstanceLister)
+	if !ok {
+		if len(task.CompletedInstances) > 0 {
+			log.Printf("Completed occurrences of '%s' cannot be marked on this calendar", task.Description)
+		}
+		return
+	}
+
+	for _, start := range task.CompletedInstances {
+		instances, err := lister.Instances(context.Background(), event.ID, start, start.Add(time.Minute))
+		if err != nil {
+			log.Printf("Error fetching the occurrence of '%s' at %s: %v", task.Description, start, err)
+			continue
+		}
+		for _, instance := range instances {
+			if strings.HasPrefix(instance.Summary, "✅") {
+				continue
+			}
+			instance.Summary = fmt.Sprintf("✅ %s", instance.Summary)
+			e.enqueue(&operation{
+				taskID: task.ID, description: task.Description,
+				mutation: backend.Mutation{Op: backend.OpUpdate, Event: instance},
+			})
+		}
+	}
+}
+
+// pullChanges applies to the task the fields changed on the calendar event,
+// and writes them back to the task source. When the task changed as well,
+// the configured conflict rules decide which side wins for each field.
+func (e *Engine) pullChanges(task model.Task, event *backend.Event, taskChanged bool) (model.Task, error) {
+	remote, err := util.TaskFromEvent(event)
+	if err != nil {
+		return task, err
+	}
+
+	var fields []string
+	// wins tells whether the calendar value of the field is kept
+	wins := func(field string) bool {
+		if taskChanged && e.conflicts[field] != ConflictCalendarWins {
+			log.Printf("Task %s and its event both changed %s, keeping the task value", task.Description, field)
+			return false
+		}
+		return true
+	}
+	pull := func(field string) bool {
+		if !wins(field) {
+			return false
+		}
+		fields = append(fields, field)
+		return true
+	}
+
+	status := task.Status
+	// Tasks not completed nor deleted (e.g. waiting) show as pending events
+	taskStatus := task.Status
+	if taskStatus != "completed" && taskStatus != "deleted" {
+		taskStatus = "pending"
+	}
+	if remote.Status != taskStatus && pull(util.NEEDS_UPDATE_STATUS) {
+		task.Status = remote.Status
+	}
+	if remote.Description != task.Description && pull(util.NEEDS_UPDATE_DESCRIPTION) {
+		task.Description = remote.Description
+	}
+	// Moving or resizing the event changes the task dates its start and end
+	// are computed from. The due conflict rule applies to all of them.
+	start, end := util.TaskSpan(&task)
+	startField, endField := e.timing.Fields(&task)
+	length := func(from, to time.Time) time.Duration {
+		if remote.AllDay {
+			// Whole days, whatever the DST changes in between
+			return to.Sub(from).Round(24 * time.Hour)
+		}
+		return to.Sub(from)
+	}
+	moved := !remote.Start.IsZero() && !remote.Start.Equal(start)
+	resized := !remote.End.IsZero() && length(remote.Start, remote.End) != length(start, end)
+	if (moved || resized) && wins(util.NEEDS_UPDATE_DUE) {
+		if moved {
+			util.SetTaskDate(&task, startField, remote.Start)
+			fields = append(fields, startField)
+		}
+		switch {
+		case endField == util.TIMING_DURATION && resized:
+			task.Duration = length(remote.Start, remote.End)
+			fields = append(fields, endField)
+		case endField != util.TIMING_DURATION && !remote.End.Equal(end):
+			util.SetTaskDate(&task, endField, remote.End)
+			fields = append(fields, endField)
+		}
+		task.Start = remote.Start
+		task.End = remote.End
+		task.AllDay = remote.AllDay
+	}
+
+	if len(fields) == 0 {
+		return task, nil
+	}
+	if e.dryRun {
+		log.Printf("Would write calendar changes (%s) back to task: %s", strings.Join(fields, ", "), task.Description)
+		return task, nil
+	}
+	log.Printf("Writing calendar changes (%s) back to task: %s", strings.Join(fields, ", "), task.Description)
+	err = e.writer.WriteBack(task, fields)
+	if errors.Is(err, model.ErrStatusUnsupported) {
+		// The task keeps its status, and its event gets it back
+		log.Printf("Not applying the status of the event of task %s, restoring the event: %v", task.Description, err)
+		task.Status = status
+		return task, nil
+	}
+	return task, err
+}
+
+// remember records the event linked to the task in the state store.
+func (e *Engine) remember(task model.Task, event *backend.Event, hash string) {
+	e.store.Put(state.Mapping{
+		TaskID:     task.ID,
+		CalendarID: e.calendarID,
+		EventID:    event.ID,
+		ETag:       event.ETag,
+		Hash:       hash,
+		LastSynced: time.Now(),
+		Scope:      task.Scope,
+	})
+}
+
+// PruneOrphans deletes the events this tool created for tasks that are no
+// longer returned by the sources. Only events recorded in the state store for
+// one of the given scopes are considered, so events of other sources, filters
+// or archived files are never touched. An orphan is deleted only after it has
+// been missing for longer than the grace period. The deletions are queued and
+// applied by Flush.
+func (e *Engine) PruneOrphans(scopes []string, tasks []model.Task, grace time.Duration) {
+	inScope := make(map[string]bool)
+	for _, scope := range scopes {
+		inScope[scope] = true
+	}
+	active := make(map[string]bool)
+	for _, task := range tasks {
+		active[task.ID] = true
+	}
+
+	e.ensureEvents()
+	now := time.Now()
+	for _, m := range e.store.List() {
+		if m.CalendarID != e.calendarID || !inScope[m.Scope] || active[m.TaskID] {
+			continue
+		}
+
+		if m.OrphanedSince == nil {
+			log.Printf("Task %s is no longer in scope '%s', its event will be deleted after %s", m.TaskID, m.Scope, grace)
+			m.OrphanedSince = &now
+			e.store.Put(m)
+			continue
+		}
+		if now.Sub(*m.OrphanedSince) < grace {
+			continue
+		}
+
+		var err error
+		event, ok := e.cachedEvent(m.EventID)
+		if !ok {
+			event, err = e.backend.GetEvent(context.Background(), m.EventID)
+		}
+		if errors.Is(err, backend.ErrNotFound) {
+			e.store.Delete(m.TaskID)
+			continue
+		}
+		if err != nil {
+			log.Printf("Error fetching orphaned event %s: %v", m.EventID, err)
+			e.record(m.TaskID, m.TaskID, ActionDelete, err)
+			continue
+		}
+		// The event metadata must confirm the ownership recorded in the store
+		if event.Property(util.PropertyScope) != m.Scope {
+			log.Printf("Not deleting event '%s': it is not owned by scope '%s'", event.Summary, m.Scope)
+			e.store.Delete(m.TaskID)
+			continue
+		}
+
+		log.Printf("Deleting orphaned event '%s' for task %s", event.Summary, m.TaskID)
+		taskID, eventID := m.TaskID, m.EventID
+		e.enqueue(&operation{
+			taskID: taskID, description: event.Summary, action: ActionDelete,
+			mutation: backend.Mutation{Op: backend.OpDelete, ID: eventID},
+			done: func(_ *backend.Event, err error) error {
+				if err != nil && !errors.Is(err, backend.ErrNotFound) {
+					return err
+				}
+				e.forgetEvent(eventID)
+				e.store.Delete(taskID)
+				return nil
+			},
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/state"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+)
+
+// fakeBackend keeps the events of a calendar in memory.
+type fakeBackend struct {
+	events  map[string]*backend.Event
+	version int
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{events: make(map[string]*backend.Event)}
+}
+
+func (f *fakeBackend) CalendarID() string { return "fake" }
+
+func (f *fakeBackend) ListEvents(_ context.Context, query backend.Query) ([]*backend.Event, error) {
+	var events []*backend.Event
+next:
+	for _, event := range f.events {
+		for key, value := range query.Properties {
+			if event.Property(key) != value {
+				continue next
+			}
+		}
+		copied := *event
+		events = append(events, &copied)
+	}
+	return events, nil
+}
+
+func (f *fakeBackend) GetEvent(_ context.Context, id string) (*backend.Event, error) {
+	event, ok := f.events[id]
+	if !ok {
+		return nil, backend.ErrNotFound
+	}
+	copied := *event
+	return &copied, nil
+}
+
+func (f *fakeBackend) InsertEvent(_ context.Context, event *backend.Event) (*backend.Event, error) {
+	f.version++
+	stored := *event
+	stored.ID = fmt.Sprintf("event-%d", f.version)
+	return f.store(&stored), nil
+}
+
+func (f *fakeBackend) UpdateEvent(_ context.Context, event *backend.Event) (*backend.Event, error) {
+	if _, ok := f.events[event.ID]; !ok {
+		return nil, backend.ErrNotFound
+	}
+	f.version++
+	stored := *event
+	return f.store(&stored), nil
+}
+
+func (f *fakeBackend) DeleteEvent(_ context.Context, id string) error {
+	if _, ok := f.events[id]; !ok {
+		return backend.ErrNotFound
+	}
+	delete(f.events, id)
+	return nil
+}
+
+// store saves the event with a new ETag and returns a copy of it.
+func (f *fakeBackend) store(event *backend.Event) *backend.Event {
+	event.ETag = fmt.Sprintf("etag-%d", f.version)
+	event.Updated = time.Now()
+	f.events[event.ID] = event
+	copied := *event
+	return &copied
+}
+
+// fakeWriter records the changes written back, and cannot delete tasks, as
+// the Org-mode writer.
+type fakeWriter struct {
+	written []string
+}
+
+func (w *fakeWriter) WriteBack(task model.Task, fields []string) error {
+	w.written = append(w.written, fields...)
+	if task.Status == "deleted" {
+		return fmt.Errorf("no deleted state: %w", model.ErrStatusUnsupported)
+	}
+	return nil
+}
+
+func newTestEngine(t *testing.T, be backend.CalendarBackend) *Engine {
+	store, err := state.Load(filepath.Join(t.TempDir(), state.StateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(be, store)
+}
+
+func checkOutcomes(t *testing.T, outcomes []Outcome, action string) {
+	t.Helper()
+	if len(outcomes) != 1 || outcomes[0].Action != action || outcomes[0].Err != nil {
+		t.Fatalf("got outcomes %+v, want a single %s", outcomes, action)
+	}
+}
+
+func TestUnsupportedDeletionRestoresEvent(t *testing.T) {
+	be := newFakeBackend()
+	e := newTestEngine(t, be)
+	writer := &fakeWriter{}
+	e.EnableTwoWay(writer, nil, util.TimingRules{})
+
+	task := model.Task{
+		ID: "task-1", Description: "write tests", Status: "pending", Source: "notes.org", Scope: "notes.org",
+		Deadline: time.Date(2025, 6, 1, 9, 0, 0, 0, time.Local),
+	}
+	if err := e.SyncEvent(task); err != nil {
+		t.Fatal(err)
+	}
+	checkOutcomes(t, e.Flush(), ActionCreate)
+	m, ok := e.store.Get(task.ID)
+	if !ok {
+		t.Fatal("event not linked to the task")
+	}
+
+	// The event is deleted from the calendar, the task stays as it is
+	delete(be.events, m.EventID)
+	if err := e.SyncEvent(task); err != nil {
+		t.Fatal(err)
+	}
+	checkOutcomes(t, e.Flush(), ActionCreate)
+
+	if len(writer.written) != 1 || writer.written[0] != "status" {
+		t.Errorf("got fields %v written back, want the status only", writer.written)
+	}
+	restored, ok := e.store.Get(task.ID)
+	if !ok || restored.EventID == m.EventID {
+		t.Fatalf("got mapping %+v, want a new event linked to the task", restored)
+	}
+	event, err := be.GetEvent(context.Background(), restored.EventID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Status == backend.StatusCancelled || event.Summary != task.Description {
+		t.Errorf("got restored event %+v", event)
+	}
+
+	// The next sync finds the event up to date
+	if err := e.SyncEvent(task); err != nil {
+		t.Fatal(err)
+	}
+	checkOutcomes(t, e.Flush(), ActionSkip)
+}
+
+// changesBackend is a fakeBackend reading its events with sync tokens, which
+// expire when expired is set.
+type changesBackend struct {
+	*fakeBackend
+	expired bool
+	// tokens are the sync tokens of the reads
+	tokens []string
+}
+
+func (c *changesBackend) Changes(_ context.Context, syncToken string) ([]*backend.Event, string, error) {
+	c.tokens = append(c.tokens, syncToken)
+	if syncToken != "" && c.expired {
+		return nil, "", backend.ErrSyncTokenExpired
+	}
+	var events []*backend.Event
+	if syncToken == "" {
+		events, _ = c.ListEvents(context.Background(), backend.Query{})
+	}
+	return events, fmt.Sprintf("token-%d", len(c.tokens)), nil
+}
+
+func TestExpiredSyncTokenReadsAllEvents(t *testing.T) {
+	be := &changesBackend{fakeBackend: newFakeBackend(), expired: true}
+	be.events["current"] = &backend.Event{ID: "current", ETag: "etag-1"}
+	e := newTestEngine(t, be)
+	// A previous run cached an event deleted since
+	e.store.SetSyncToken(be.CalendarID(), "old")
+	e.store.PutEvent(be.CalendarID(), "stale", []byte(`{"id":"stale"}`))
+
+	e.ensureEvents()
+
+	if want := []string{"old", ""}; !reflect.DeepEqual(be.tokens, want) {
+		t.Errorf("got reads with tokens %q, want %q", be.tokens, want)
+	}
+	if _, ok := e.events["current"]; !ok || len(e.events) != 1 {
+		t.Errorf("got events %v, want the current one only", e.events)
+	}
+	token, cached := e.store.Cache(be.CalendarID())
+	if _, ok := cached["stale"]; ok || token != "token-2" {
+		t.Errorf("got cache %v with token %q, want the stale event dropped and token-2", cached, token)
+	}
+}
+
+func TestPruneOrphansGracePeriod(t *testing.T) {
+	be := newFakeBackend()
+	e := newTestEngine(t, be)
+	due := time.Date(2025, 6, 1, 9, 0, 0, 0, time.Local)
+	tasks := []model.Task{
+		{ID: "task-1", Description: "orphan", Status: "pending", Scope: "work", Deadline: due},
+		{ID: "task-2", Description: "other scope", Status: "pending", Scope: "home", Deadline: due},
+	}
+	for _, task := range tasks {
+		if err := e.SyncEvent(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Flush()
+	m, _ := e.store.Get("task-1")
+
+	// The tasks are gone: the orphan is only marked, the other scope is
+	// left alone
+	for i := 0; i < 2; i++ {
+		e.PruneOrphans([]string{"work"}, nil, time.Hour)
+		if outcomes := e.Flush(); len(outcomes) != 0 {
+			t.Fatalf("got outcomes %+v within the grace period", outcomes)
+		}
+	}
+	marked, _ := e.store.Get("task-1")
+	if marked.OrphanedSince == nil {
+		t.Fatal("orphan not marked")
+	}
+	if other, _ := e.store.Get("task-2"); other.OrphanedSince != nil {
+		t.Error("task of another scope marked as orphan")
+	}
+
+	// Back within the grace period, the task is not an orphan anymore
+	if err := e.SyncEvent(tasks[0]); err != nil {
+		t.Fatal(err)
+	}
+	checkOutcomes(t, e.Flush(), ActionSkip)
+	if back, _ := e.store.Get("task-1"); back.OrphanedSince != nil {
+		t.Error("orphan mark kept after the task came back")
+	}
+
+	// Gone for longer than the grace period, its event is deleted
+	e.PruneOrphans([]string{"work"}, nil, time.Hour)
+	marked, _ = e.store.Get("task-1")
+	since := time.Now().Add(-2 * time.Hour)
+	marked.OrphanedSince = &since
+	e.store.Put(marked)
+	e.PruneOrphans([]string{"work"}, nil, time.Hour)
+	checkOutcomes(t, e.Flush(), ActionDelete)
+
+	if _, ok := be.events[m.EventID]; ok {
+		t.Error("orphaned event not deleted")
+	}
+	if _, ok := e.store.Get("task-1"); ok {
+		t.Error("mapping of the deleted event kept")
+	}
+	if _, ok := e.store.Get("task-2"); !ok || len(be.events) != 1 {
+		t.Error("event of another scope deleted")
+	}
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"context"
+	"log"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+)
+
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+	ActionSkip   = "skip"
+	// ActionMove is only reported in dry-run mode: the event is moved
+	// before being compared with the task.
+	ActionMove = "move"
+)
+
+// Outcome is the result of syncing a task. In dry-run mode, it is the change
+// that would be made.
+type Outcome struct {
+	TaskID      string
+	Description string
+	Action      string // create, update, delete, skip or move
+	// Reason and Changes tell why and how an event is updated, or the
+	// fields of a new event. They are only set in dry-run mode.
+	Reason  string
+	Changes []util.FieldChange
+	Err     error
+}
+
+// operation is a calendar mutation waiting to be applied.
+type operation struct {
+	taskID      string
+	description string
+	// action is reported in the outcomes. Follow-up operations, like the
+	// completion of recurring event occurrences, have none.
+	action  string
+	reason  string
+	changes []util.FieldChange
+
+	mutation backend.Mutation
+
+	// done is called with the resulting event (nil for deletions) or the
+	// error, and returns the error to report, if any
+	done func(event *backend.Event, err error) error
+}
+
+// enqueue adds a mutation to the queue. In dry-run mode, the mutation is
+// only reported in the outcomes.
+func (e *Engine) enqueue(op *operation) {
+	if e.dryRun {
+		if op.action != "" {
+			e.outcomes = append(e.outcomes, Outcome{
+				TaskID: op.taskID, Description: op.description, Action: op.action,
+				Reason: op.reason, Changes: op.changes,
+			})
+		}
+		return
+	}
+	e.pending = append(e.pending, op)
+}
+
+// record adds the outcome of a task to the final summary.
+func (e *Engine) record(taskID, description, action string, err error) {
+	e.outcomes = append(e.outcomes, Outcome{TaskID: taskID, Description: description, Action: action, Err: err})
+}
+
+// Flush applies all the queued mutations, in batches when the backend
+// supports them, and returns the outcome of every task synced or pruned
+// since the previous Flush.
+func (e *Engine) Flush() []Outcome {
+	for len(e.pending) > 0 {
+		ops := e.pending
+		e.pending = nil
+
+		mutations := make([]backend.Mutation, len(ops))
+		for i, op := range ops {
+			mutations[i] = op.mutation
+		}
+		// Callbacks may queue follow-up operations, applied in the next round
+		results := backend.Apply(context.Background(), e.backend, mutations)
+		for i, op := range ops {
+			op.finish(e, results[i].Event, results[i].Err)
+		}
+	}
+
+	outcomes := e.outcomes
+	e.outcomes = nil
+	return outcomes
+}
+
+// finish reports the result of the operation to its callback and records the
+// task outcome.
+func (op *operation) finish(e *Engine, event *backend.Event, err error) {
+	if op.done != nil {
+		err = op.done(event, err)
+	}
+	if op.action != "" {
+		e.record(op.taskID, op.description, op.action, err)
+	} else if err != nil {
+		log.Printf("Error syncing task %s: %v", op.description, err)
+	}
+}
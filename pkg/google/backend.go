@@ -0,0 +1,240 @@
+package google
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	dateLayout = "2006-01-02"
+	// maxPageSize is the largest page the Events.List API returns.
+	maxPageSize = 2500
+)
+
+// Backend is the Google Calendar implementation of backend.CalendarBackend.
+type Backend struct {
+	srv        *calendar.Service
+	httpClient *http.Client
+	limiter    *tokenBucket
+	calendarID string
+	// batchURL is the endpoint the batch requests are sent to.
+	batchURL string
+}
+
+// newBackend creates a backend for the calendar with the given ID. The
+// httpClient sends the batch requests, and must be the one srv was created
+// with, so that all the requests share the same rate limiter.
+func newBackend(srv *calendar.Service, httpClient *http.Client, limiter *tokenBucket, calendarID string) *Backend {
+	return &Backend{srv: srv, httpClient: httpClient, limiter: limiter, calendarID: calendarID, batchURL: defaultBatchURL}
+}
+
+// CalendarID returns the Google ID of the calendar.
+func (b *Backend) CalendarID() string {
+	return b.calendarID
+}
+
+// ListEvents fetches the events of the calendar selected by the query,
+// following all the result pages.
+func (b *Backend) ListEvents(ctx context.Context, query backend.Query) ([]*backend.Event, error) {
+	call := b.srv.Events.List(b.calendarID).MaxResults(maxPageSize)
+	if !query.TimeMin.IsZero() {
+		call.TimeMin(query.TimeMin.Format(time.RFC3339))
+	}
+	var filters []string
+	for key, value := range query.Properties {
+		filters = append(filters, fmt.Sprintf("%s=%s", key, value))
+	}
+	if len(filters) > 0 {
+		call.PrivateExtendedProperty(filters...)
+	}
+	if query.Text != "" {
+		call.Q(query.Text)
+	}
+
+	var events []*backend.Event
+	err := call.Pages(ctx, func(page *calendar.Events) error {
+		for _, item := range page.Items {
+			events = append(events, fromGoogle(item))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return events, nil
+}
+
+// GetEvent fetches a single event.
+func (b *Backend) GetEvent(ctx context.Context, id string) (*backend.Event, error) {
+	event, err := b.srv.Events.Get(b.calendarID, id).Context(ctx).Do()
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return fromGoogle(event), nil
+}
+
+// InsertEvent creates a new event.
+func (b *Backend) InsertEvent(ctx context.Context, event *backend.Event) (*backend.Event, error) {
+	created, err := b.srv.Events.Insert(b.calendarID, toGoogle(event)).Context(ctx).Do()
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return fromGoogle(created), nil
+}
+
+// UpdateEvent replaces an existing event.
+func (b *Backend) UpdateEvent(ctx context.Context, event *backend.Event) (*backend.Event, error) {
+	updated, err := b.srv.Events.Update(b.calendarID, event.ID, toGoogle(event)).Context(ctx).Do()
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return fromGoogle(updated), nil
+}
+
+// DeleteEvent deletes an event.
+func (b *Backend) DeleteEvent(ctx context.Context, id string) error {
+	return convertError(b.srv.Events.Delete(b.calendarID, id).Context(ctx).Do())
+}
+
+// Changes implements backend.ChangeReader with the Events.List sync tokens.
+func (b *Backend) Changes(ctx context.Context, syncToken string) ([]*backend.Event, string, error) {
+	call := b.srv.Events.List(b.calendarID).MaxResults(maxPageSize)
+	if syncToken != "" {
+		call.SyncToken(syncToken)
+	}
+
+	var events []*backend.Event
+	var nextToken string
+	err := call.Pages(ctx, func(page *calendar.Events) error {
+		for _, item := range page.Items {
+			events = append(events, fromGoogle(item))
+		}
+		nextToken = page.NextSyncToken
+		return nil
+	})
+	if isGone(err) {
+		return nil, "", backend.ErrSyncTokenExpired
+	}
+	if err != nil {
+		return nil, "", convertError(err)
+	}
+	return events, nextToken, nil
+}
+
+// MoveEvent implements backend.Mover.
+func (b *Backend) MoveEvent(ctx context.Context, calendarID, id string) (*backend.Event, error) {
+	event, err := b.srv.Events.Move(calendarID, id, b.calendarID).Context(ctx).Do()
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return fromGoogle(event), nil
+}
+
+// Instances implements backend.InstanceLister.
+func (b *Backend) Instances(ctx context.Context, id string, timeMin, timeMax time.Time) ([]*backend.Event, error) {
+	instances, err := b.srv.Events.Instances(b.calendarID, id).
+		TimeMin(timeMin.Format(time.RFC3339)).
+		TimeMax(timeMax.Format(time.RFC3339)).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, convertError(err)
+	}
+	var events []*backend.Event
+	for _, item := range instances.Items {
+		events = append(events, fromGoogle(item))
+	}
+	return events, nil
+}
+
+// toGoogle returns the Google representation of an event. All-day events use
+// dates, timed events UTC times.
+func toGoogle(event *backend.Event) *calendar.Event {
+	g := &calendar.Event{
+		Summary:     event.Summary,
+		Description: event.Description,
+		Status:      event.Status,
+		Recurrence:  event.Recurrence,
+		ColorId:     event.Color,
+	}
+	if len(event.Properties) > 0 {
+		g.ExtendedProperties = &calendar.EventExtendedProperties{Private: event.Properties}
+	}
+
+	if event.AllDay {
+		g.Start = &calendar.EventDateTime{Date: event.Start.Format(dateLayout)}
+		g.End = &calendar.EventDateTime{Date: event.End.Format(dateLayout)}
+	} else {
+		g.Start = &calendar.EventDateTime{DateTime: event.Start.UTC().Format(time.RFC3339), TimeZone: event.TimeZone}
+		g.End = &calendar.EventDateTime{DateTime: event.End.UTC().Format(time.RFC3339), TimeZone: event.TimeZone}
+	}
+	return g
+}
+
+// fromGoogle returns the neutral representation of a Google event. The dates
+// of all-day events become local midnights. Deleted events returned by
+// incremental reads may only have their ID and status.
+func fromGoogle(g *calendar.Event) *backend.Event {
+	event := &backend.Event{
+		ID:          g.Id,
+		UID:         g.ICalUID,
+		ETag:        g.Etag,
+		Summary:     g.Summary,
+		Description: g.Description,
+		Status:      g.Status,
+		Recurrence:  g.Recurrence,
+		Color:       g.ColorId,
+	}
+	if g.ExtendedProperties != nil {
+		event.Properties = g.ExtendedProperties.Private
+	}
+	if g.Updated != "" {
+		event.Updated, _ = time.Parse(time.RFC3339, g.Updated)
+	}
+
+	parse := func(edt *calendar.EventDateTime) time.Time {
+		if edt == nil {
+			return time.Time{}
+		}
+		if edt.DateTime != "" {
+			t, _ := time.Parse(time.RFC3339, edt.DateTime)
+			return t
+		}
+		event.AllDay = true
+		t, _ := time.ParseInLocation(dateLayout, edt.Date, time.Local)
+		return t
+	}
+	event.Start = parse(g.Start)
+	event.End = parse(g.End)
+	if g.Start != nil {
+		event.TimeZone = g.Start.TimeZone
+	}
+	return event
+}
+
+// convertError turns the "not found" and "gone" API errors into
+// backend.ErrNotFound.
+func convertError(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && (apiErr.Code == http.StatusNotFound || apiErr.Code == http.StatusGone) {
+		return fmt.Errorf("%w: %v", backend.ErrNotFound, err)
+	}
+	return err
+}
+
+// isGone reports whether err is a "gone" API error, returned when a sync
+// token is no longer valid.
+func isGone(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusGone
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package google
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/option"
+)
+
+// newTestBackend returns a backend of the calendar "primary" sending all its
+// requests, batches included, to handler.
+func newTestBackend(t *testing.T, handler http.Handler) *Backend {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	limiter := newTokenBucket(1000, 1000)
+	client := &http.Client{Transport: &retryTransport{base: http.DefaultTransport, limiter: limiter}}
+	srv, err := calendar.NewService(context.Background(), option.WithHTTPClient(client), option.WithEndpoint(server.URL+"/calendar/v3/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBackend(srv, client, limiter, "primary")
+	b.batchURL = server.URL + "/batch/calendar/v3"
+	return b
+}
+
+func TestChangesExpiredToken(t *testing.T) {
+	b := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("syncToken") != "" {
+			w.WriteHeader(http.StatusGone)
+			io.WriteString(w, `{"error":{"code":410,"message":"Sync token is no longer valid, a full sync is required."}}`)
+			return
+		}
+		io.WriteString(w, `{"items":[{"id":"e1","status":"confirmed","start":{"date":"2025-06-01"},"end":{"date":"2025-06-02"}}],"nextSyncToken":"next"}`)
+	}))
+
+	if _, _, err := b.Changes(context.Background(), "old"); !errors.Is(err, backend.ErrSyncTokenExpired) {
+		t.Errorf("got error %v, want %v", err, backend.ErrSyncTokenExpired)
+	}
+	events, token, err := b.Changes(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ID != "e1" || !events[0].AllDay || token != "next" {
+		t.Errorf("got events %+v and token %q", events, token)
+	}
+}
+
+func TestGetEventNotFound(t *testing.T) {
+	b := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"error":{"code":404,"message":"Not Found"}}`)
+	}))
+	if _, err := b.GetEvent(context.Background(), "missing"); !errors.Is(err, backend.ErrNotFound) {
+		t.Errorf("got error %v, want %v", err, backend.ErrNotFound)
+	}
+}
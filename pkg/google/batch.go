@@ -0,0 +1,257 @@
+package google
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// defaultBatchURL is the batch endpoint of the Calendar API.
+	defaultBatchURL = "https://www.googleapis.com/batch/calendar/v3"
+	// maxBatchSize is the number of calls Google accepts in a batch request.
+	maxBatchSize = 50
+)
+
+// batchCall is a mutation sent as a call of a batch request.
+type batchCall struct {
+	index    int // of the mutation
+	method   string
+	path     string
+	body     interface{}
+	attempts int
+}
+
+// Apply implements backend.Batcher, sending the mutations in batch requests
+// of up to 50 calls. Calls failing because of rate limits, and updates and
+// deletions failing because of server errors, are sent again with
+// exponential backoff.
+func (b *Backend) Apply(ctx context.Context, mutations []backend.Mutation) []backend.Result {
+	results := make([]backend.Result, len(mutations))
+	var calls []*batchCall
+	for i, m := range mutations {
+		call := &batchCall{index: i}
+		switch m.Op {
+		case backend.OpInsert:
+			call.method, call.path, call.body = http.MethodPost, eventsPath(b.calendarID, ""), toGoogle(m.Event)
+		case backend.OpUpdate:
+			call.method, call.path, call.body = http.MethodPut, eventsPath(b.calendarID, m.Event.ID), toGoogle(m.Event)
+		case backend.OpDelete:
+			call.method, call.path = http.MethodDelete, eventsPath(b.calendarID, m.ID)
+		default:
+			results[i].Err = fmt.Errorf("unsupported mutation '%s'", m.Op)
+			continue
+		}
+		calls = append(calls, call)
+	}
+
+	for len(calls) > 0 {
+		var retry []*batchCall
+		for start := 0; start < len(calls); start += maxBatchSize {
+			end := start + maxBatchSize
+			if end > len(calls) {
+				end = len(calls)
+			}
+			retry = append(retry, b.executeBatch(ctx, calls[start:end], results)...)
+		}
+		if len(retry) == 0 {
+			break
+		}
+
+		attempt := 0
+		for _, call := range retry {
+			if call.attempts > attempt {
+				attempt = call.attempts
+			}
+		}
+		wait := backoff(attempt-1, "")
+		log.Printf("Retrying %d calendar operations in %s", len(retry), wait.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			for _, call := range retry {
+				results[call.index].Err = ctx.Err()
+			}
+			return results
+		case <-time.After(wait):
+		}
+		calls = retry
+	}
+	return results
+}
+
+// eventsPath returns the API path of the events of the calendar, or of a
+// single event when eventID is not empty.
+func eventsPath(calendarID, eventID string) string {
+	path := "/calendar/v3/calendars/" + url.PathEscape(calendarID) + "/events"
+	if eventID != "" {
+		path += "/" + url.PathEscape(eventID)
+	}
+	return path
+}
+
+// executeBatch sends a batch of calls and stores their results. The calls
+// that failed with a transient error are returned to be retried.
+func (b *Backend) executeBatch(ctx context.Context, calls []*batchCall, results []backend.Result) []*batchCall {
+	// The transport takes the token of the batch request itself, but each
+	// call in the batch counts against the quota.
+	if len(calls) > 1 {
+		if err := b.limiter.WaitN(ctx, len(calls)-1); err != nil {
+			log.Printf("Error waiting for the rate limiter: %v", err)
+		}
+	}
+
+	responses, err := b.doBatch(ctx, calls)
+	if err != nil {
+		for _, call := range calls {
+			results[call.index].Err = fmt.Errorf("batch request failed: %w", err)
+		}
+		return nil
+	}
+
+	var retry []*batchCall
+	for i, call := range calls {
+		resp := responses[i]
+		if resp == nil {
+			results[call.index].Err = fmt.Errorf("no response in batch for %s %s", call.method, call.path)
+			continue
+		}
+		if retryableStatus(call.method, resp.code, resp.body) && call.attempts < maxRetries {
+			call.attempts++
+			retry = append(retry, call)
+			continue
+		}
+		event, err := resp.event()
+		if err != nil {
+			results[call.index].Err = convertError(err)
+			continue
+		}
+		if event != nil {
+			results[call.index].Event = fromGoogle(event)
+		}
+	}
+	return retry
+}
+
+// batchResponse is the response to a single call of a batch.
+type batchResponse struct {
+	code   int
+	header http.Header
+	body   []byte
+}
+
+// event decodes the event returned by the call, or the API error.
+func (r *batchResponse) event() (*calendar.Event, error) {
+	if r.code < 200 || r.code > 299 {
+		return nil, googleapi.CheckResponse(&http.Response{
+			StatusCode: r.code,
+			Header:     r.header,
+			Body:       io.NopCloser(bytes.NewReader(r.body)),
+		})
+	}
+	if len(bytes.TrimSpace(r.body)) == 0 {
+		return nil, nil
+	}
+	event := &calendar.Event{}
+	if err := json.Unmarshal(r.body, event); err != nil {
+		return nil, fmt.Errorf("unable to decode event: %w", err)
+	}
+	return event, nil
+}
+
+// doBatch sends the calls as a single multipart/mixed request to the batch
+// endpoint and returns the responses in the same order.
+func (b *Backend) doBatch(ctx context.Context, calls []*batchCall) ([]*batchResponse, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, call := range calls {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-ID", fmt.Sprintf("<item%d>", i))
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(part, "%s %s HTTP/1.1\r\n", call.method, call.path)
+		if call.body == nil {
+			fmt.Fprint(part, "\r\n")
+			continue
+		}
+		payload, err := json.Marshal(call.body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode request: %w", err)
+		}
+		fmt.Fprintf(part, "Content-Type: application/json\r\nContent-Length: %d\r\n\r\n", len(payload))
+		part.Write(payload)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.batchURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected batch response: %w", err)
+	}
+
+	responses := make([]*batchResponse, len(calls))
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read batch response: %w", err)
+		}
+
+		// The response IDs are the request ones prefixed with "response-"
+		id := strings.Trim(part.Header.Get("Content-ID"), "<>")
+		i, err := strconv.Atoi(strings.TrimPrefix(id, "response-item"))
+		if err != nil || i < 0 || i >= len(calls) {
+			log.Printf("Ignoring unexpected batch response part '%s'", id)
+			continue
+		}
+
+		r, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read batch response: %w", err)
+		}
+		payload, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read batch response: %w", err)
+		}
+		responses[i] = &batchResponse{code: r.StatusCode, header: r.Header, body: payload}
+	}
+	return responses, nil
+}
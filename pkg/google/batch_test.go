@@ -0,0 +1,203 @@
+package google
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+)
+
+// batchServer answers the batch requests, each call with answer, the
+// responses being sent in the reverse order of the calls.
+type batchServer struct {
+	mu      sync.Mutex
+	batches int
+	answer  func(method, path, body string) (int, string)
+}
+
+func (s *batchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches++
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.URL.Path != "/batch/calendar/v3" || err != nil {
+		http.Error(w, "not a batch request", http.StatusBadRequest)
+		return
+	}
+
+	type call struct {
+		id     string
+		code   int
+		answer string
+	}
+	var calls []call
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		code, answer := s.answer(req.Method, req.URL.Path, string(body))
+		calls = append(calls, call{id: strings.Trim(part.Header.Get("Content-ID"), "<>"), code: code, answer: answer})
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	for i := len(calls) - 1; i >= 0; i-- {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-ID", "<response-"+calls[i].id+">")
+		part, _ := mw.CreatePart(header)
+		fmt.Fprintf(part, "HTTP/1.1 %d %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s",
+			calls[i].code, http.StatusText(calls[i].code), len(calls[i].answer), calls[i].answer)
+	}
+	mw.Close()
+}
+
+const notFound = `{"error":{"code":404,"message":"Not Found"}}`
+
+func TestApplyBatch(t *testing.T) {
+	server := &batchServer{answer: func(method, path, body string) (int, string) {
+		switch {
+		case method == http.MethodPost && path == "/calendar/v3/calendars/primary/events":
+			if !strings.Contains(body, `"summary":"new"`) {
+				return http.StatusBadRequest, `{"error":{"code":400,"message":"bad event"}}`
+			}
+			return http.StatusOK, `{"id":"e3","etag":"\"3\"","summary":"new"}`
+		case method == http.MethodPut && path == "/calendar/v3/calendars/primary/events/e1":
+			return http.StatusOK, `{"id":"e1","etag":"\"2\"","summary":"changed"}`
+		case method == http.MethodDelete && path == "/calendar/v3/calendars/primary/events/e2":
+			return http.StatusNoContent, ""
+		}
+		return http.StatusNotFound, notFound
+	}}
+	b := newTestBackend(t, server)
+
+	start := time.Date(2025, 6, 1, 9, 0, 0, 0, time.UTC)
+	results := b.Apply(context.Background(), []backend.Mutation{
+		{Op: backend.OpInsert, Event: &backend.Event{Summary: "new", Start: start, End: start.Add(time.Hour)}},
+		{Op: backend.OpUpdate, Event: &backend.Event{ID: "e1", Summary: "changed", Start: start, End: start.Add(time.Hour)}},
+		{Op: backend.OpDelete, ID: "e2"},
+		{Op: backend.OpDelete, ID: "missing"},
+	})
+
+	if server.batches != 1 {
+		t.Errorf("got %d batch requests, want 1", server.batches)
+	}
+	if r := results[0]; r.Err != nil || r.Event == nil || r.Event.ID != "e3" || r.Event.ETag != `"3"` {
+		t.Errorf("insert: got %+v", r)
+	}
+	if r := results[1]; r.Err != nil || r.Event == nil || r.Event.ID != "e1" || r.Event.Summary != "changed" {
+		t.Errorf("update: got %+v", r)
+	}
+	if r := results[2]; r.Err != nil || r.Event != nil {
+		t.Errorf("delete: got %+v", r)
+	}
+	if r := results[3]; !errors.Is(r.Err, backend.ErrNotFound) {
+		t.Errorf("delete of a missing event: got %+v, want %v", r, backend.ErrNotFound)
+	}
+}
+
+func TestApplyBatchSplit(t *testing.T) {
+	server := &batchServer{answer: func(method, path, body string) (int, string) {
+		return http.StatusNoContent, ""
+	}}
+	b := newTestBackend(t, server)
+
+	mutations := make([]backend.Mutation, maxBatchSize+1)
+	for i := range mutations {
+		mutations[i] = backend.Mutation{Op: backend.OpDelete, ID: fmt.Sprintf("e%d", i)}
+	}
+	for i, r := range b.Apply(context.Background(), mutations) {
+		if r.Err != nil {
+			t.Errorf("mutation %d: %v", i, r.Err)
+		}
+	}
+	if server.batches != 2 {
+		t.Errorf("got %d batch requests, want 2", server.batches)
+	}
+}
+
+func TestApplyRetries(t *testing.T) {
+	// Each call fails the first time it is sent
+	sent := make(map[string]int)
+	server := &batchServer{answer: func(method, path, body string) (int, string) {
+		key := method + " " + path + " " + body
+		sent[key]++
+		if sent[key] > 1 {
+			if method == http.MethodDelete {
+				return http.StatusNoContent, ""
+			}
+			return http.StatusOK, `{"id":"done"}`
+		}
+		if strings.Contains(body, "rate limited") {
+			return http.StatusForbidden, `{"error":{"code":403,"errors":[{"reason":"rateLimitExceeded"}],"message":"Rate Limit Exceeded"}}`
+		}
+		return http.StatusServiceUnavailable, `{"error":{"code":503,"message":"Backend Error"}}`
+	}}
+	b := newTestBackend(t, server)
+
+	start := time.Date(2025, 6, 1, 9, 0, 0, 0, time.UTC)
+	event := func(summary string) *backend.Event {
+		return &backend.Event{ID: "e1", Summary: summary, Start: start, End: start.Add(time.Hour)}
+	}
+	results := b.Apply(context.Background(), []backend.Mutation{
+		{Op: backend.OpUpdate, Event: event("server error")},
+		{Op: backend.OpDelete, ID: "e2"},
+		{Op: backend.OpInsert, Event: event("rate limited")},
+		// A POST failing with a server error may have created the event:
+		// sending it again could duplicate it
+		{Op: backend.OpInsert, Event: event("server error")},
+	})
+
+	for i, r := range results[:3] {
+		if r.Err != nil {
+			t.Errorf("mutation %d not retried: %v", i, r.Err)
+		}
+	}
+	if results[3].Err == nil {
+		t.Error("insert failing with a server error was retried")
+	}
+	if server.batches != 2 {
+		t.Errorf("got %d batch requests, want 2", server.batches)
+	}
+}
+
+func TestApplyBatchFailure(t *testing.T) {
+	requests := 0
+	b := newTestBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, `{"error":{"code":503,"message":"Backend Error"}}`, http.StatusServiceUnavailable)
+	}))
+
+	results := b.Apply(context.Background(), []backend.Mutation{{Op: backend.OpDelete, ID: "e1"}})
+	if results[0].Err == nil {
+		t.Error("got no error")
+	}
+	// The batch is a POST: its calls may have been applied
+	if requests != 1 {
+		t.Errorf("got %d batch requests, want 1", requests)
+	}
+}
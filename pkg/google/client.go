@@ -3,45 +3,136 @@ package google
 import (
 	"context"
 	"fmt"
+	"log"
+	"net/http"
+	"regexp"
 
 	"github.com/clobrano/TaskwarriorAgenda/pkg/auth"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
 	"google.golang.org/api/calendar/v3"
 	"google.golang.org/api/option"
 )
 
-// NewClient creates a new Google Calendar client.
-func NewClient(calendarName string) (*CalendarClient, error) {
-	ctx := context.Background()
-	scopes := []string{
-		calendar.CalendarEventsScope,
-		calendar.CalendarReadonlyScope,
+// calendarColorRegex matches the colors of the created calendars.
+var calendarColorRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// CalendarOptions tell how the calendars that do not exist are handled.
+type CalendarOptions struct {
+	// Create makes Backend create the missing calendars, instead of failing.
+	Create bool
+	// TimeZone of the created calendars, the local one when empty.
+	TimeZone string
+	// Color of the created calendars, as "#rrggbb", the default one when
+	// empty.
+	Color string
+}
+
+// Service is an authenticated Google Calendar client, shared by the backends
+// of all its calendars.
+type Service struct {
+	srv        *calendar.Service
+	httpClient *http.Client
+	limiter    *tokenBucket
+	options    CalendarOptions
+}
+
+// NewService authenticates with the Google Calendar API.
+func NewService(options CalendarOptions) (*Service, error) {
+	if options.Color != "" && !calendarColorRegex.MatchString(options.Color) {
+		return nil, fmt.Errorf("invalid calendar color '%s', expected #rrggbb", options.Color)
 	}
-	client, err := auth.GetClient(ctx, scopes)
+
+	ctx := context.Background()
+	client, err := auth.GetClient(ctx, auth.Scopes)
 	if err != nil {
 		return nil, err
 	}
 
+	// All the API calls, batches included, go through the rate limiter and
+	// are retried on rate limit and server errors
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	limiter := newTokenBucket(DefaultRequestsPerSecond, DefaultBurst)
+	client.Transport = &retryTransport{base: base, limiter: limiter}
+
 	srv, err := calendar.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
 		return nil, fmt.Errorf("unable to retrieve Calendar client: %v", err)
 	}
+	return &Service{srv: srv, httpClient: client, limiter: limiter, options: options}, nil
+}
 
-	calendarList, err := srv.CalendarList.List().Do()
+// Backend returns the backend of the calendar with the given ID or name.
+// The ID keeps working when the calendar is renamed. A missing calendar is
+// created, if the options allow it.
+func (s *Service) Backend(calendarName string) (*Backend, error) {
+	ctx := context.Background()
+	calendarID, err := s.findCalendar(ctx, calendarName)
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve calendar list: %v", err)
+		return nil, err
+	}
+
+	if calendarID == "" {
+		if !s.options.Create {
+			return nil, fmt.Errorf("calendar '%s' not found", calendarName)
+		}
+		if calendarID, err = s.createCalendar(ctx, calendarName); err != nil {
+			return nil, err
+		}
 	}
 
-	var calendarID string
-	for _, item := range calendarList.Items {
-		if item.Summary == calendarName {
-			calendarID = item.Id
-			break
+	return newBackend(s.srv, s.httpClient, s.limiter, calendarID), nil
+}
+
+// findCalendar returns the ID of the calendar with the given ID, or else with
+// the given name, or an empty string if there is none.
+func (s *Service) findCalendar(ctx context.Context, calendarName string) (string, error) {
+	var byID, byName string
+	err := s.srv.CalendarList.List().MaxResults(250).Pages(ctx, func(page *calendar.CalendarList) error {
+		for _, item := range page.Items {
+			if item.Id == calendarName {
+				byID = item.Id
+			}
+			// The name the user gave to a shared calendar is an override
+			if byName == "" && (item.Summary == calendarName || item.SummaryOverride == calendarName) {
+				byName = item.Id
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to retrieve calendar list: %v", err)
 	}
 
-	if calendarID == "" {
-		return nil, fmt.Errorf("calendar '%s' not found", calendarName)
+	if byID != "" {
+		return byID, nil
+	}
+	if byName != "" {
+		log.Printf("Using calendar '%s' (ID %s)", calendarName, byName)
 	}
+	return byName, nil
+}
 
-	return NewCalendarClient(srv, calendarID), nil
+// createCalendar creates a secondary calendar with the given name and returns
+// its ID.
+func (s *Service) createCalendar(ctx context.Context, calendarName string) (string, error) {
+	timeZone := s.options.TimeZone
+	if timeZone == "" {
+		timeZone = util.LocalTimeZone()
+	}
+	created, err := s.srv.Calendars.Insert(&calendar.Calendar{Summary: calendarName, TimeZone: timeZone}).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to create calendar '%s' (tokens obtained by older versions lack the permission: run auth again): %w", calendarName, err)
+	}
+	log.Printf("Created calendar '%s' (ID %s) in time zone %s", calendarName, created.Id, timeZone)
+
+	if s.options.Color != "" {
+		entry := &calendar.CalendarListEntry{BackgroundColor: s.options.Color, ForegroundColor: "#000000"}
+		if _, err := s.srv.CalendarList.Patch(created.Id, entry).ColorRgbFormat(true).Context(ctx).Do(); err != nil {
+			log.Printf("Error setting the color of calendar '%s': %v", calendarName, err)
+		}
+	}
+	return created.Id, nil
 }
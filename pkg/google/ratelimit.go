@@ -0,0 +1,158 @@
+package google
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRequestsPerSecond and DefaultBurst configure the token bucket
+	// limiting the requests sent to the Calendar API, well below the default
+	// per-user quota.
+	DefaultRequestsPerSecond = 5
+	DefaultBurst             = 10
+
+	// maxRetries is how many times a rate limited or failed request is retried.
+	maxRetries = 5
+	// maxBackoff caps the exponential backoff between retries.
+	maxBackoff = 32 * time.Second
+)
+
+// tokenBucket is a simple token bucket rate limiter.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// WaitN blocks until n tokens are available, or the context is done.
+func (b *tokenBucket) WaitN(ctx context.Context, n int) error {
+	for n > 0 {
+		// Never ask for more than the bucket can hold at once
+		take := float64(n)
+		if take > b.burst {
+			take = b.burst
+		}
+
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+
+		if b.tokens >= take {
+			b.tokens -= take
+			b.mu.Unlock()
+			n -= int(take)
+			continue
+		}
+		wait := time.Duration((take - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return nil
+}
+
+// retryTransport is an http.RoundTripper that waits for the rate limiter
+// before each request and retries with exponential backoff the requests
+// failing because of rate limits (429 or 403 rateLimitExceeded) or, unless
+// they are POST requests, server errors (5xx).
+type retryTransport struct {
+	base    http.RoundTripper
+	limiter *tokenBucket
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.WaitN(req.Context(), 1); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || attempt >= maxRetries || !retryableResponse(req.Method, resp) {
+			return resp, err
+		}
+		// The body must be sent again: give up when it cannot be replayed
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+
+		wait := backoff(attempt, resp.Header.Get("Retry-After"))
+		resp.Body.Close()
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// retryableResponse reports whether the request can succeed if sent again.
+// The body of 403 responses is inspected, since Google reports rate limits
+// with 403 too, and is restored for the caller.
+func retryableResponse(method string, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusForbidden {
+		return retryableStatus(method, resp.StatusCode, nil)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return err == nil && retryableStatus(method, resp.StatusCode, body)
+}
+
+// retryableStatus reports whether an API response status (and body) tells a
+// rate limit or a transient server error. Rate limited requests were not
+// processed, but a POST failing with a server error may have been: inserting
+// the event again would duplicate it, and so would sending a batch again.
+func retryableStatus(method string, code int, body []byte) bool {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return true
+	case code >= 500:
+		return method != http.MethodPost
+	case code == http.StatusForbidden:
+		return bytes.Contains(body, []byte("RateLimitExceeded")) || bytes.Contains(body, []byte("rateLimitExceeded"))
+	}
+	return false
+}
+
+// backoff returns how long to wait before the next attempt: the server
+// Retry-After if any, or an exponential delay with jitter.
+func backoff(attempt int, retryAfter string) time.Duration {
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	wait := time.Second << attempt
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait + time.Duration(rand.Int63n(int64(time.Second)))
+}
@@ -0,0 +1,122 @@
+package google
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryableStatus(t *testing.T) {
+	rateLimited := []byte(`{"error":{"errors":[{"domain":"usageLimits","reason":"rateLimitExceeded"}],"code":403}}`)
+	userRateLimited := []byte(`{"error":{"errors":[{"domain":"usageLimits","reason":"userRateLimitExceeded"}],"code":403}}`)
+	forbidden := []byte(`{"error":{"errors":[{"domain":"global","reason":"forbidden"}],"code":403}}`)
+	tests := []struct {
+		name   string
+		method string
+		code   int
+		body   []byte
+		want   bool
+	}{
+		{name: "ok", method: http.MethodGet, code: http.StatusOK},
+		{name: "too many requests", method: http.MethodGet, code: http.StatusTooManyRequests, want: true},
+		{name: "too many POST requests", method: http.MethodPost, code: http.StatusTooManyRequests, want: true},
+		{name: "rate limit", method: http.MethodPost, code: http.StatusForbidden, body: rateLimited, want: true},
+		{name: "user rate limit", method: http.MethodPut, code: http.StatusForbidden, body: userRateLimited, want: true},
+		{name: "forbidden", method: http.MethodGet, code: http.StatusForbidden, body: forbidden},
+		{name: "server error", method: http.MethodGet, code: http.StatusInternalServerError, want: true},
+		{name: "update server error", method: http.MethodPut, code: http.StatusServiceUnavailable, want: true},
+		{name: "delete server error", method: http.MethodDelete, code: http.StatusBadGateway, want: true},
+		{name: "POST server error", method: http.MethodPost, code: http.StatusServiceUnavailable},
+		{name: "not found", method: http.MethodGet, code: http.StatusNotFound},
+		{name: "gone", method: http.MethodGet, code: http.StatusGone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryableStatus(tt.method, tt.code, tt.body); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	if got := backoff(3, "2"); got != 2*time.Second {
+		t.Errorf("got %s with Retry-After, want 2s", got)
+	}
+	tests := []struct {
+		attempt int
+		min     time.Duration
+	}{
+		{attempt: 0, min: time.Second},
+		{attempt: 2, min: 4 * time.Second},
+		{attempt: 10, min: maxBackoff},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempt, ""); got < tt.min || got >= tt.min+time.Second {
+			t.Errorf("attempt %d: got %s, want %s plus less than a second of jitter", tt.attempt, got, tt.min)
+		}
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		// first is the status of the first response, the next ones are 200
+		first    int
+		body     string
+		requests int
+		want     int
+	}{
+		{name: "rate limit", method: http.MethodPut, first: http.StatusTooManyRequests, requests: 2, want: http.StatusOK},
+		{name: "403 rate limit", method: http.MethodGet, first: http.StatusForbidden, body: "rateLimitExceeded", requests: 2, want: http.StatusOK},
+		{name: "forbidden", method: http.MethodGet, first: http.StatusForbidden, body: "forbidden", requests: 1, want: http.StatusForbidden},
+		{name: "server error", method: http.MethodDelete, first: http.StatusServiceUnavailable, requests: 2, want: http.StatusOK},
+		{name: "POST server error", method: http.MethodPost, first: http.StatusServiceUnavailable, requests: 1, want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var bodies []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				bodies = append(bodies, string(body))
+				if len(bodies) == 1 {
+					w.Header().Set("Retry-After", "1")
+					http.Error(w, tt.body, tt.first)
+					return
+				}
+				io.WriteString(w, "ok")
+			}))
+			defer server.Close()
+
+			client := &http.Client{Transport: &retryTransport{base: http.DefaultTransport, limiter: newTokenBucket(1000, 1000)}}
+			req, err := http.NewRequest(tt.method, server.URL, strings.NewReader("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.want || len(bodies) != tt.requests {
+				t.Errorf("got status %d after %d requests, want %d after %d", resp.StatusCode, len(bodies), tt.want, tt.requests)
+			}
+			for i, sent := range bodies {
+				if sent != "payload" {
+					t.Errorf("request %d sent body %q, want the payload", i, sent)
+				}
+			}
+			// The body of the 403 responses is read to find the reason, and
+			// must still be there for the caller
+			if tt.want != http.StatusOK && !strings.Contains(string(body), tt.body) {
+				t.Errorf("got body %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
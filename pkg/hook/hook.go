@@ -0,0 +1,86 @@
+package hook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The Taskwarrior hook events the hook can be installed for.
+const (
+	OnAdd    = "on-add"
+	OnModify = "on-modify"
+)
+
+// scriptSuffix is appended to the event to name the installed hook scripts.
+const scriptSuffix = ".taskwarrior-agenda"
+
+// Task holds the fields of a hook task needed to queue it.
+type Task struct {
+	UUID   string `json:"uuid"`
+	Parent string `json:"parent,omitempty"`
+}
+
+// Read reads the JSON task lines Taskwarrior passes to the hook of event: the
+// added task for on-add, the original and the modified task for on-modify.
+// It returns the line of the task that is being saved, which the hook must
+// print back, unchanged, for Taskwarrior to accept it.
+func Read(r io.Reader, event string) ([]byte, Task, error) {
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return nil, Task{}, fmt.Errorf("unable to read hook input: %w", err)
+	}
+	lines := bytes.Split(bytes.TrimRight(input, "\n"), []byte("\n"))
+
+	line := lines[len(lines)-1]
+
+	expected := 1
+	if event == OnModify {
+		expected = 2
+	} else if event != OnAdd {
+		return line, Task{}, fmt.Errorf("unsupported hook event '%s'", event)
+	}
+	if len(lines) != expected {
+		return line, Task{}, fmt.Errorf("%s hook expects %d task lines, got %d", event, expected, len(lines))
+	}
+	var task Task
+	if err := json.Unmarshal(line, &task); err != nil {
+		return line, Task{}, fmt.Errorf("unable to decode hook task: %w", err)
+	}
+	if task.UUID == "" {
+		return line, Task{}, fmt.Errorf("hook task has no uuid")
+	}
+	return line, task, nil
+}
+
+// Install writes the on-add and on-modify hook scripts running executable
+// to the Taskwarrior hooks directory, and returns their paths.
+func Install(hooksDir, executable string) ([]string, error) {
+	if err := os.MkdirAll(hooksDir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create hooks directory %s: %w", hooksDir, err)
+	}
+
+	var paths []string
+	for _, event := range []string{OnAdd, OnModify} {
+		path := filepath.Join(hooksDir, event+scriptSuffix)
+		script := fmt.Sprintf("#!/bin/sh\nexec %s hook %s\n", shellQuote(executable), event)
+		if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+			return paths, fmt.Errorf("unable to write hook %s: %w", path, err)
+		}
+		// WriteFile keeps the mode of an existing file
+		if err := os.Chmod(path, 0755); err != nil {
+			return paths, fmt.Errorf("unable to make hook %s executable: %w", path, err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// shellQuote quotes s as a single shell word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
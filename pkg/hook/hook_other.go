@@ -0,0 +1,8 @@
+//go:build !unix
+
+package hook
+
+import "os/exec"
+
+// Detach is a no-op where sessions are not supported.
+func Detach(cmd *exec.Cmd) {}
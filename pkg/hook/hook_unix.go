@@ -0,0 +1,14 @@
+//go:build unix
+
+package hook
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Detach makes cmd run in its own session, so that it outlives the hook and
+// the terminal Taskwarrior was run from.
+func Detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,74 @@
+package hook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/clobrano/TaskwarriorAgenda/internal/fsutil"
+)
+
+// Queue is a directory of tasks waiting to be synced. Each task is an empty
+// file named after its ID, so that a task queued several times is synced
+// once, and adding a task never waits for a sync in progress.
+type Queue struct {
+	dir string
+}
+
+// NewQueue returns the queue kept in dir. The directory is created on the
+// first Add.
+func NewQueue(dir string) *Queue {
+	return &Queue{dir: dir}
+}
+
+// Add queues the task with the given ID.
+func (q *Queue) Add(taskID string) error {
+	if taskID == "" || strings.ContainsAny(taskID, `/\`) || strings.HasPrefix(taskID, ".") {
+		return fmt.Errorf("invalid task ID '%s'", taskID)
+	}
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return fmt.Errorf("unable to create queue directory %s: %w", q.dir, err)
+	}
+	f, err := os.OpenFile(filepath.Join(q.dir, taskID), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to queue task %s: %w", taskID, err)
+	}
+	return f.Close()
+}
+
+// Take removes the queued tasks from the queue and returns their IDs. The
+// tasks queued again while they are synced stay in the queue for the next
+// Take.
+func (q *Queue) Take() ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to read queue directory %s: %w", q.dir, err)
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(q.dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return ids, fmt.Errorf("unable to remove task %s from the queue: %w", entry.Name(), err)
+		}
+		ids = append(ids, entry.Name())
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Lock waits until no other process is syncing the queue, and takes its
+// place. The returned function releases the lock.
+func (q *Queue) Lock() (func(), error) {
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create queue directory %s: %w", q.dir, err)
+	}
+	return fsutil.LockFile(filepath.Join(q.dir, ".lock"))
+}
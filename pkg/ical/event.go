@@ -0,0 +1,250 @@
+package ical
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+)
+
+const (
+	// ProdID identifies this tool in the calendars it writes.
+	ProdID = "-//clobrano//TaskwarriorAgenda//EN"
+
+	dateLayout     = "20060102"
+	dateTimeLayout = "20060102T150405"
+	utcLayout      = "20060102T150405Z"
+
+	// propertyPrefix marks the private properties of events.
+	propertyPrefix = "X-"
+)
+
+// NewCalendar creates an empty VCALENDAR.
+func NewCalendar() *Component {
+	c := NewComponent("VCALENDAR")
+	c.Add("VERSION", "2.0", nil)
+	c.Add("PRODID", ProdID, nil)
+	c.Add("CALSCALE", "GREGORIAN", nil)
+	return c
+}
+
+// EventToComponent returns the VEVENT of an event. Timed events are written
+// in UTC, but the recurring ones: they are written in the floating local time
+// of their time zone, so that the occurrences keep their time across DST
+// changes. The private properties become X- properties.
+func EventToComponent(event *backend.Event) *Component {
+	c := NewComponent("VEVENT")
+	c.Add("UID", event.UID, nil)
+	addStamps(c, event.Updated)
+	loc := recurrenceLocation(event)
+	if loc != nil {
+		c.Add("DTSTART", event.Start.In(loc).Format(dateTimeLayout), nil)
+		c.Add("DTEND", event.End.In(loc).Format(dateTimeLayout), nil)
+	} else {
+		addDate(c, "DTSTART", event.Start, event.AllDay)
+		addDate(c, "DTEND", event.End, event.AllDay)
+	}
+	c.AddText("SUMMARY", event.Summary)
+	if event.Description != "" {
+		c.AddText("DESCRIPTION", event.Description)
+	}
+	if event.Status != "" {
+		c.Add("STATUS", strings.ToUpper(event.Status), nil)
+	}
+	if color := backend.CSSColor(event.Color); color != "" {
+		c.Add("COLOR", color, nil)
+	}
+	for _, rule := range event.Recurrence {
+		if p, err := ParseLine(rule); err == nil {
+			if loc != nil {
+				// The exceptions and the end must be floating times too
+				p = convertTimes(p, floatingIn(loc))
+			}
+			c.Properties = append(c.Properties, p)
+		}
+	}
+	keys := make([]string, 0, len(event.Properties))
+	for key := range event.Properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c.AddText(propertyPrefix+strings.ToUpper(key), event.Properties[key])
+	}
+	return c
+}
+
+// recurrenceLocation returns the location the times of recurring timed events
+// are written in, or nil for the other events.
+func recurrenceLocation(event *backend.Event) *time.Location {
+	if len(event.Recurrence) == 0 || event.AllDay {
+		return nil
+	}
+	if event.TimeZone != "" {
+		if loc, err := time.LoadLocation(event.TimeZone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// convertTimes rewrites with convert the times of an EXDATE or RDATE property,
+// or the UNTIL of an RRULE.
+func convertTimes(p Property, convert func(string) string) Property {
+	switch p.Name {
+	case "RRULE":
+		parts := strings.Split(p.Value, ";")
+		for i, part := range parts {
+			if until, found := strings.CutPrefix(part, "UNTIL="); found {
+				parts[i] = "UNTIL=" + convert(until)
+			}
+		}
+		p.Value = strings.Join(parts, ";")
+	case "EXDATE", "RDATE":
+		if p.Params["VALUE"] == "DATE" || p.Params["TZID"] != "" {
+			break
+		}
+		values := strings.Split(p.Value, ",")
+		for i := range values {
+			values[i] = convert(values[i])
+		}
+		p.Value = strings.Join(values, ",")
+	}
+	return p
+}
+
+// floatingIn converts UTC times to floating times in loc.
+func floatingIn(loc *time.Location) func(string) string {
+	return func(value string) string {
+		if t, err := time.Parse(utcLayout, value); err == nil {
+			return t.In(loc).Format(dateTimeLayout)
+		}
+		return value
+	}
+}
+
+// utcFrom converts floating times in loc to UTC times.
+func utcFrom(loc *time.Location) func(string) string {
+	return func(value string) string {
+		if t, err := time.ParseInLocation(dateTimeLayout, value, loc); err == nil {
+			return formatUTC(t)
+		}
+		return value
+	}
+}
+
+// addStamps adds DTSTAMP and LAST-MODIFIED. Without a METHOD, DTSTAMP is the
+// time of the last revision: the current time when that is unknown.
+func addStamps(c *Component, modified time.Time) {
+	if modified.IsZero() {
+		c.Add("DTSTAMP", formatUTC(time.Now()), nil)
+		return
+	}
+	c.Add("DTSTAMP", formatUTC(modified), nil)
+	c.Add("LAST-MODIFIED", formatUTC(modified), nil)
+}
+
+// formatUTC returns a UTC DATE-TIME value.
+func formatUTC(t time.Time) string {
+	return t.UTC().Format(utcLayout)
+}
+
+// addDate adds a DATE property for all-day dates, or a UTC DATE-TIME one.
+func addDate(c *Component, name string, t time.Time, allDay bool) {
+	if allDay {
+		c.Add(name, t.Format(dateLayout), map[string]string{"VALUE": "DATE"})
+		return
+	}
+	c.Add(name, formatUTC(t), nil)
+}
+
+// EventFromComponent returns the event of a VEVENT.
+func EventFromComponent(c *Component) (*backend.Event, error) {
+	event := &backend.Event{
+		UID:         c.Text("UID"),
+		Summary:     c.Text("SUMMARY"),
+		Description: c.Text("DESCRIPTION"),
+		Status:      strings.ToLower(c.Text("STATUS")),
+	}
+	if event.Status == "" || event.Status == "tentative" {
+		event.Status = backend.StatusConfirmed
+	}
+	if color := c.Text("COLOR"); color != "" {
+		// Colors other than the event ones are left to the calendar
+		event.Color, _ = backend.ColorID(color)
+	}
+
+	start := c.Get("DTSTART")
+	if start == nil {
+		return nil, fmt.Errorf("event %s has no DTSTART", event.UID)
+	}
+	var err error
+	if event.Start, event.AllDay, err = parseDate(*start); err != nil {
+		return nil, err
+	}
+	switch {
+	case c.Get("DTEND") != nil:
+		if event.End, _, err = parseDate(*c.Get("DTEND")); err != nil {
+			return nil, err
+		}
+	case c.Get("DURATION") != nil:
+		duration, err := util.ParseDuration(c.Get("DURATION").Value)
+		if err != nil {
+			return nil, err
+		}
+		event.End = event.Start.Add(duration)
+	case event.AllDay:
+		event.End = event.Start.AddDate(0, 0, 1)
+	default:
+		event.End = event.Start
+	}
+	if tz := start.Params["TZID"]; tz != "" {
+		event.TimeZone = tz
+	}
+	// The recurrences of floating events are kept in UTC, as they are written
+	floating := !event.AllDay && start.Params["TZID"] == "" && !strings.HasSuffix(start.Value, "Z")
+
+	if p := c.Get("LAST-MODIFIED"); p != nil {
+		event.Updated, _ = time.Parse(utcLayout, p.Value)
+	}
+	for _, p := range c.Properties {
+		switch {
+		case p.Name == "RRULE" || p.Name == "RDATE" || p.Name == "EXDATE" || p.Name == "EXRULE":
+			if floating {
+				p = convertTimes(p, utcFrom(time.Local))
+			}
+			event.Recurrence = append(event.Recurrence, p.String())
+		case strings.HasPrefix(p.Name, propertyPrefix):
+			if event.Properties == nil {
+				event.Properties = make(map[string]string)
+			}
+			key := strings.ToLower(strings.TrimPrefix(p.Name, propertyPrefix))
+			event.Properties[key] = UnescapeText(p.Value)
+		}
+	}
+	return event, nil
+}
+
+// parseDate parses a DATE or DATE-TIME property. Dates and floating times
+// are local, times with a TZID are in that zone, if known.
+func parseDate(p Property) (t time.Time, allDay bool, err error) {
+	if p.Params["VALUE"] == "DATE" || len(p.Value) == len(dateLayout) {
+		t, err = time.ParseInLocation(dateLayout, p.Value, time.Local)
+		return t, true, err
+	}
+	if strings.HasSuffix(p.Value, "Z") {
+		t, err = time.Parse(utcLayout, p.Value)
+		return t, false, err
+	}
+	loc := time.Local
+	if tz := p.Params["TZID"]; tz != "" {
+		if l, err := time.LoadLocation(tz); err == nil {
+			loc = l
+		}
+	}
+	t, err = time.ParseInLocation(dateTimeLayout, p.Value, loc)
+	return t, false, err
+}
@@ -0,0 +1,127 @@
+package ical
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+)
+
+func TestRecurringEventFloating(t *testing.T) {
+	rome, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 9:00 in Rome, before the change to summer time
+	start := time.Date(2025, 3, 10, 9, 0, 0, 0, rome)
+	event := &backend.Event{
+		UID:      "weekly",
+		Summary:  "weekly",
+		Start:    start,
+		End:      start.Add(time.Hour),
+		TimeZone: "Europe/Rome",
+		Recurrence: []string{
+			"RRULE:FREQ=WEEKLY;UNTIL=20250430T070000Z",
+			"EXDATE:20250407T070000Z",
+		},
+	}
+
+	c := EventToComponent(event)
+	for name, want := range map[string]string{
+		"DTSTART": "20250310T090000",
+		"DTEND":   "20250310T100000",
+		"RRULE":   "FREQ=WEEKLY;UNTIL=20250430T090000",
+		"EXDATE":  "20250407T090000",
+	} {
+		if got := c.Get(name); got == nil || got.Value != want {
+			t.Errorf("got %s %v, want %s", name, got, want)
+		}
+	}
+
+	// Read back, the recurrence is the one written
+	local := time.Local
+	time.Local = rome
+	defer func() { time.Local = local }()
+	read, err := EventFromComponent(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !read.Start.Equal(start) || strings.Join(read.Recurrence, "\n") != strings.Join(event.Recurrence, "\n") {
+		t.Errorf("got start %v and recurrence %q, want %v and %q", read.Start, read.Recurrence, start, event.Recurrence)
+	}
+}
+
+func TestSingleEventUTC(t *testing.T) {
+	start := time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)
+	c := EventToComponent(&backend.Event{UID: "once", Start: start, End: start.Add(time.Hour)})
+	if got := c.Get("DTSTART"); got == nil || got.Value != "20250310T090000Z" {
+		t.Errorf("got DTSTART %v, want UTC", got)
+	}
+}
+
+func TestTaskToTodoDates(t *testing.T) {
+	deadline := time.Date(2025, 3, 10, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		name      string
+		task      model.Task
+		wantDue   string
+		wantStart string
+	}{
+		{
+			name:      "scheduled before",
+			task:      model.Task{ID: "1", Deadline: deadline.Add(18 * time.Hour), Scheduled: deadline.Add(9 * time.Hour)},
+			wantDue:   "20250310T180000",
+			wantStart: "20250310T090000",
+		},
+		{
+			name:    "scheduled at due",
+			task:    model.Task{ID: "2", Deadline: deadline.Add(18 * time.Hour), Scheduled: deadline.Add(18 * time.Hour)},
+			wantDue: "20250310T180000",
+		},
+		{
+			name:      "all-day with timed scheduled",
+			task:      model.Task{ID: "3", Deadline: deadline, AllDay: true, Scheduled: deadline.Add(-15 * time.Hour)},
+			wantDue:   "20250310",
+			wantStart: "20250309",
+		},
+		{
+			name:    "all-day scheduled the same day",
+			task:    model.Task{ID: "4", Deadline: deadline.Add(23 * time.Hour), AllDay: true, Scheduled: deadline.Add(9 * time.Hour)},
+			wantDue: "20250310",
+		},
+		{
+			name:      "recurring",
+			task:      model.Task{ID: "5", Deadline: deadline, AllDay: true, Recurrence: []string{"RRULE:FREQ=DAILY"}},
+			wantStart: "20250310",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := TaskToTodo(&tt.task)
+			due, start := c.Get("DUE"), c.Get("DTSTART")
+			if got := value(due); !strings.HasPrefix(got, tt.wantDue) || (got == "") != (tt.wantDue == "") {
+				t.Errorf("got DUE %q, want %q", got, tt.wantDue)
+			}
+			if got := value(start); !strings.HasPrefix(got, tt.wantStart) || (got == "") != (tt.wantStart == "") {
+				t.Errorf("got DTSTART %q, want %q", got, tt.wantStart)
+			}
+			if due != nil && start != nil && due.Params["VALUE"] != start.Params["VALUE"] {
+				t.Errorf("DUE %v and DTSTART %v have different value types", due, start)
+			}
+		})
+	}
+}
+
+// value returns the value of the property written in local time, or an empty
+// string.
+func value(p *Property) string {
+	if p == nil {
+		return ""
+	}
+	if t, err := time.Parse(utcLayout, p.Value); err == nil {
+		return t.In(time.Local).Format(dateTimeLayout)
+	}
+	return p.Value
+}
@@ -0,0 +1,96 @@
+package ical
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Feed is an HTTP handler serving a generated iCalendar file. The file is
+// cached for maxAge, and its ETag and Last-Modified only change when its
+// content does, so that clients can poll it with conditional requests.
+type Feed struct {
+	generate func() ([]byte, error)
+	maxAge   time.Duration
+
+	mu        sync.Mutex
+	body      []byte
+	etag      string
+	modified  time.Time
+	generated time.Time
+}
+
+// NewFeed creates a feed of the iCalendar files returned by generate.
+func NewFeed(generate func() ([]byte, error), maxAge time.Duration) *Feed {
+	return &Feed{generate: generate, maxAge: maxAge}
+}
+
+// Refresh generates the feed again.
+func (f *Feed) Refresh() error {
+	f.mu.Lock()
+	f.generated = time.Time{}
+	f.mu.Unlock()
+	_, _, _, err := f.get()
+	return err
+}
+
+// get returns the feed, generating it again when it is too old.
+func (f *Feed) get() (body []byte, etag string, modified time.Time, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.body == nil || f.generated.IsZero() || time.Since(f.generated) >= f.maxAge {
+		body, err := f.generate()
+		if err != nil {
+			return nil, "", time.Time{}, err
+		}
+		f.generated = time.Now()
+		if etag := contentTag(body); etag != f.etag {
+			f.body = body
+			f.etag = etag
+			// HTTP dates have a one second resolution
+			f.modified = f.generated.Truncate(time.Second)
+		}
+	}
+	return f.body, f.etag, f.modified, nil
+}
+
+func (f *Feed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, etag, modified, err := f.get()
+	if err != nil {
+		log.Printf("Error generating the calendar: %v", err)
+		http.Error(w, "unable to generate the calendar", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("ETag", etag)
+	// ServeContent answers conditional requests (If-None-Match, If-Modified-Since)
+	http.ServeContent(w, r, "calendar.ics", modified, bytes.NewReader(body))
+}
+
+// contentTag returns the ETag of an iCalendar file. DTSTAMP lines are left
+// out, since they may hold the generation time.
+func contentTag(body []byte) string {
+	h := sha256.New()
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if !bytes.HasPrefix(scanner.Bytes(), []byte("DTSTAMP")) {
+			h.Write(scanner.Bytes())
+			h.Write([]byte("\n"))
+		}
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
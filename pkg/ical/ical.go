@@ -0,0 +1,247 @@
+// Package ical reads and writes iCalendar (RFC 5545) data.
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// maxLineLength is the length, in octets, lines are folded at.
+const maxLineLength = 75
+
+// Property is a content line: NAME;PARAM=VALUE:value.
+type Property struct {
+	Name   string
+	Params map[string]string
+	// Value is raw: TEXT values must go through EscapeText and UnescapeText.
+	Value string
+}
+
+// Component is a BEGIN:NAME ... END:NAME block, e.g. a VCALENDAR or a VEVENT.
+type Component struct {
+	Name       string
+	Properties []Property
+	Components []*Component
+}
+
+// NewComponent creates an empty component.
+func NewComponent(name string) *Component {
+	return &Component{Name: name}
+}
+
+// Add appends a property to the component.
+func (c *Component) Add(name, value string, params map[string]string) {
+	c.Properties = append(c.Properties, Property{Name: name, Params: params, Value: value})
+}
+
+// AddText appends a TEXT property, escaping its value.
+func (c *Component) AddText(name, value string) {
+	c.Add(name, EscapeText(value), nil)
+}
+
+// Get returns the first property with the given name, or nil.
+func (c *Component) Get(name string) *Property {
+	for i := range c.Properties {
+		if c.Properties[i].Name == name {
+			return &c.Properties[i]
+		}
+	}
+	return nil
+}
+
+// Text returns the unescaped value of the first property with the given
+// name, or an empty string.
+func (c *Component) Text(name string) string {
+	if p := c.Get(name); p != nil {
+		return UnescapeText(p.Value)
+	}
+	return ""
+}
+
+// Children returns the sub-components with the given name.
+func (c *Component) Children(name string) []*Component {
+	var children []*Component
+	for _, child := range c.Components {
+		if child.Name == name {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// String returns the content line of the property, not folded.
+func (p Property) String() string {
+	var b strings.Builder
+	b.WriteString(p.Name)
+	keys := make([]string, 0, len(p.Params))
+	for key := range p.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := p.Params[key]
+		if strings.ContainsAny(value, ";:,") {
+			value = `"` + value + `"`
+		}
+		fmt.Fprintf(&b, ";%s=%s", key, value)
+	}
+	b.WriteString(":")
+	b.WriteString(p.Value)
+	return b.String()
+}
+
+// ParseLine parses an unfolded content line.
+func ParseLine(line string) (Property, error) {
+	var p Property
+	// The value starts at the first colon not inside a quoted parameter
+	quoted := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return p, fmt.Errorf("invalid content line '%s'", line)
+	}
+	p.Value = line[colon+1:]
+
+	parts := splitParams(line[:colon])
+	p.Name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		key, value, found := strings.Cut(param, "=")
+		if !found {
+			return p, fmt.Errorf("invalid parameter '%s' in '%s'", param, line)
+		}
+		if p.Params == nil {
+			p.Params = make(map[string]string)
+		}
+		p.Params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+	}
+	return p, nil
+}
+
+// splitParams splits the name and parameters of a content line on the
+// semicolons not inside quotes.
+func splitParams(s string) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ';' && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Encode writes the component with CRLF line endings and lines folded at 75
+// octets.
+func Encode(w io.Writer, c *Component) error {
+	bw := bufio.NewWriter(w)
+	writeLine(bw, "BEGIN:"+c.Name)
+	for _, p := range c.Properties {
+		writeLine(bw, p.String())
+	}
+	for _, child := range c.Components {
+		if err := Encode(bw, child); err != nil {
+			return err
+		}
+	}
+	writeLine(bw, "END:"+c.Name)
+	return bw.Flush()
+}
+
+// writeLine writes a content line, folded without splitting UTF-8 sequences.
+func writeLine(w *bufio.Writer, line string) {
+	length := 0
+	for _, r := range line {
+		size := len(string(r))
+		if length+size > maxLineLength {
+			w.WriteString("\r\n ")
+			length = 1
+		}
+		w.WriteRune(r)
+		length += size
+	}
+	w.WriteString("\r\n")
+}
+
+// Decode reads the first component of the data, e.g. a VCALENDAR.
+func Decode(r io.Reader) (*Component, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var stack []*Component
+	for _, line := range lines {
+		p, err := ParseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		switch p.Name {
+		case "BEGIN":
+			c := NewComponent(strings.ToUpper(p.Value))
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Components = append(parent.Components, c)
+			}
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(p.Value) {
+				return nil, fmt.Errorf("unexpected END:%s", p.Value)
+			}
+			if len(stack) == 1 {
+				return stack[0], nil
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("property %s outside of a component", p.Name)
+			}
+			c := stack[len(stack)-1]
+			c.Properties = append(c.Properties, p)
+		}
+	}
+	return nil, fmt.Errorf("no complete component found")
+}
+
+// unfold returns the content lines of the data, joining the folded ones.
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// EscapeText escapes a TEXT value.
+func EscapeText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// UnescapeText reverts EscapeText.
+func UnescapeText(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(s)
+}
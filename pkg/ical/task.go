@@ -0,0 +1,137 @@
+package ical
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+)
+
+// Kinds of components tasks are exported as
+const (
+	KindEvent = "event"
+	KindTodo  = "todo"
+	KindBoth  = "both"
+)
+
+// uidDomain makes the UIDs derived from task IDs globally unique.
+const uidDomain = "taskwarrioragenda"
+
+// TasksToCalendar returns a VCALENDAR with a VEVENT (KindEvent), a VTODO
+// (KindTodo) or both (KindBoth) for each task. Tasks that cannot be placed in
+// the calendar, e.g. without a due date, get no VEVENT.
+func TasksToCalendar(tasks []model.Task, kind string) *Component {
+	cal := NewCalendar()
+	for i := range tasks {
+		task := &tasks[i]
+		if kind == KindEvent || kind == KindBoth {
+			vevent, err := TaskToEvent(task)
+			if err != nil {
+				log.Printf("Not exporting event for task '%s': %v", task.Description, err)
+			} else {
+				cal.Components = append(cal.Components, vevent)
+			}
+		}
+		if kind == KindTodo || kind == KindBoth {
+			cal.Components = append(cal.Components, TaskToTodo(task))
+		}
+	}
+	return cal
+}
+
+// TaskToEvent returns the VEVENT of a task, as it would be synced to a
+// calendar. Its UID only depends on the task ID.
+func TaskToEvent(task *model.Task) (*Component, error) {
+	event, err := util.ConvertTaskToCalendarEvent(task)
+	if err != nil {
+		return nil, err
+	}
+	// The sync metadata is of no use to subscribers
+	event.Properties = nil
+	event.UID = fmt.Sprintf("%s@%s", task.ID, uidDomain)
+	event.Updated = task.Modified
+
+	vevent := EventToComponent(event)
+	addTaskProperties(vevent, task)
+	return vevent, nil
+}
+
+// TaskToTodo returns the VTODO of a task. Its UID only depends on the task ID,
+// and differs from the one of the VEVENT.
+func TaskToTodo(task *model.Task) *Component {
+	vtodo := NewComponent("VTODO")
+	vtodo.Add("UID", fmt.Sprintf("%s-todo@%s", task.ID, uidDomain), nil)
+	addStamps(vtodo, task.Modified)
+	vtodo.AddText("SUMMARY", task.Description)
+
+	switch task.Status {
+	case "completed":
+		vtodo.Add("STATUS", "COMPLETED", nil)
+		vtodo.Add("PERCENT-COMPLETE", "100", nil)
+	case "deleted":
+		vtodo.Add("STATUS", "CANCELLED", nil)
+	default:
+		vtodo.Add("STATUS", "NEEDS-ACTION", nil)
+	}
+
+	switch {
+	case task.Deadline.IsZero():
+	case len(task.Recurrence) > 0:
+		// Recurrences are expanded from DTSTART, and DUE must be later than
+		// DTSTART: recurring to-dos are anchored at their due time, as DTSTART
+		// alone.
+		addDate(vtodo, "DTSTART", task.Deadline, task.AllDay)
+		for _, rule := range task.Recurrence {
+			if p, err := ParseLine(rule); err == nil {
+				vtodo.Properties = append(vtodo.Properties, p)
+			}
+		}
+	default:
+		addDate(vtodo, "DUE", task.Deadline, task.AllDay)
+		// DTSTART has the value type of DUE, and must be before it
+		start, due := task.Scheduled, task.Deadline
+		if task.AllDay {
+			start, due = util.StartOfDay(start), util.StartOfDay(due)
+		}
+		if !task.Scheduled.IsZero() && start.Before(due) {
+			addDate(vtodo, "DTSTART", start, task.AllDay)
+		}
+	}
+
+	addTaskProperties(vtodo, task)
+	return vtodo
+}
+
+// addTaskProperties adds the task tags and priority to a component.
+func addTaskProperties(c *Component, task *model.Task) {
+	if len(task.Tags) > 0 {
+		categories := make([]string, 0, len(task.Tags))
+		for _, tag := range task.Tags {
+			if tag != "" {
+				categories = append(categories, EscapeText(tag))
+			}
+		}
+		if len(categories) > 0 {
+			c.Add("CATEGORIES", strings.Join(categories, ","), nil)
+		}
+	}
+	if priority := Priority(task.Priority); priority > 0 {
+		c.Add("PRIORITY", fmt.Sprint(priority), nil)
+	}
+}
+
+// Priority returns the iCalendar priority (1 highest, 9 lowest, 0 undefined)
+// of a Taskwarrior (H, M, L) or Org-mode (A, B, C) priority.
+func Priority(priority string) int {
+	switch strings.ToUpper(priority) {
+	case "H", "A":
+		return 1
+	case "M", "B":
+		return 5
+	case "L", "C":
+		return 9
+	}
+	return 0
+}
@@ -1,6 +1,9 @@
 package model
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
 // Task represents a generic task from any source.
 type Task struct {
@@ -8,7 +11,52 @@ type Task struct {
 	Description string
 	Deadline    time.Time
 	Tags        []string
+	Project     string // e.g. "Work.Reports"
 	Priority    string
 	Status      string
 	Source      string // "taskwarrior" or "orgmode"
+	// Scope identifies the source and filter the task was fetched with.
+	// Orphaned events are only pruned within the scope that created them.
+	Scope string
+	// Modified is the last time the task was changed in its source, if known.
+	Modified time.Time
+
+	// Scheduled, Wait and Until are the other task dates, if known.
+	Scheduled time.Time
+	Wait      time.Time
+	Until     time.Time
+	// Duration is the estimated effort, if known.
+	Duration time.Duration
+	// Start and End are the time span of the calendar event, as computed by
+	// util.ApplyTiming. When not set, the event starts at the Deadline.
+	Start time.Time
+	End   time.Time
+	// AllDay is true when the deadline is a date without a time of day.
+	AllDay bool
+
+	// Recurrence holds the RFC 5545 RRULE and EXDATE lines of a recurring
+	// task. The Deadline is the start of the first occurrence.
+	Recurrence []string
+	// CompletedInstances are the starts of the completed occurrences of a
+	// recurring task.
+	CompletedInstances []time.Time
+	// Color is the ID of the event color (see backend.ColorID), if any.
+	Color string
+
+	// Parent is the ID of the recurring task this task is an occurrence of.
+	Parent string
+}
+
+// ErrStatusUnsupported is returned by Writer.WriteBack when the source cannot
+// represent the new status of the task, e.g. Org-mode deleted tasks. The other
+// fields are written anyway.
+var ErrStatusUnsupported = errors.New("status not supported by the task source")
+
+// Writer is implemented by the task sources that can apply the changes made
+// on the calendar back to the original task.
+type Writer interface {
+	// WriteBack updates the given fields of the task in its source.
+	// Fields are named after the util.NEEDS_UPDATE_* values, and the dates
+	// and duration after the util.TIMING_* ones.
+	WriteBack(task Task, fields []string) error
 }
@@ -2,14 +2,15 @@ package orgmode
 
 import (
 	"bufio"
-	"fmt"
 	"io"
+	"log"
 	"os"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
 )
 
 // parseFile parses an Org-mode file and returns a slice of tasks.
@@ -37,15 +38,18 @@ func ParseFiles(filePaths []string) ([]model.Task, error) {
 
 // Parse parses an Org-mode reader and returns a slice of tasks.
 func Parse(r io.Reader, source string) ([]model.Task, error) {
-	fmt.Printf("parsing file: %s\n", source)
+	log.Printf("parsing file: %s", source)
 	scanner := bufio.NewScanner(r)
 	var tasks []model.Task
 	var currentTask *model.Task
 
 	todoRegex := regexp.MustCompile(`^\* TODO\s*(?:\[#([A-Z])\])?\s*(.*?)(?:\s+(:(\w+(:\w+)*):))?\s*$`)
 	doneRegex := regexp.MustCompile(`^\* DONE\s*(?:\[#([A-Z])\])?\s*(.*?)(?:\s+(:(\w+(:\w+)*):))?\s*$`)
-	deadlineRegex := regexp.MustCompile(`DEADLINE:\s+<(\d{4}-\d{2}-\d{2}\s+[A-Za-z]{3}\s+\d{2}:\d{2})>`)
-	idRegex := regexp.MustCompile(`:ID:\s+([a-fA-F0-9-]+)`)
+	// The time of day is optional: date-only deadlines become all-day events
+	deadlineRegex := regexp.MustCompile(`DEADLINE:\s+<(\d{4}-\d{2}-\d{2})(?:\s+[^\s\d>]+)?(?:\s+(\d{1,2}:\d{2}))?(?:\s+((?:\+\+|\.\+|\+)\d+[hdwmy]))?[^>]*>`)
+	scheduledRegex := regexp.MustCompile(`SCHEDULED:\s+<(\d{4}-\d{2}-\d{2})(?:\s+[^\s\d>]+)?(?:\s+(\d{1,2}:\d{2}))?[^>]*>`)
+	idRegex := regexp.MustCompile(`:ID:\s+(\S+)`)
+	effortRegex := regexp.MustCompile(`(?i)^:EFFORT:\s+(\S+)`)
 
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -73,13 +77,31 @@ func Parse(r io.Reader, source string) ([]model.Task, error) {
 				}
 			}
 		} else if currentTask != nil {
+			// DEADLINE and SCHEDULED can share the same planning line
 			if matches := deadlineRegex.FindStringSubmatch(line); len(matches) > 0 {
-				deadline, err := time.ParseInLocation("2006-01-02 Mon 15:04", matches[1], time.Local)
+				deadline, allDay, err := parseTimestamp(matches[1], matches[2])
 				if err == nil {
 					currentTask.Deadline = deadline
+					currentTask.AllDay = allDay
 				}
-			} else if matches := idRegex.FindStringSubmatch(line); len(matches) > 0 {
+				// Repeating deadlines become recurring events
+				if repeater, err := util.ParseOrgRepeater(matches[3]); err == nil {
+					currentTask.Recurrence = []string{repeater.RRule(time.Time{})}
+				}
+			}
+			if matches := scheduledRegex.FindStringSubmatch(line); len(matches) > 0 {
+				scheduled, _, err := parseTimestamp(matches[1], matches[2])
+				if err == nil {
+					currentTask.Scheduled = scheduled
+				}
+			}
+			if matches := idRegex.FindStringSubmatch(line); len(matches) > 0 {
 				currentTask.ID = matches[1]
+			} else if matches := effortRegex.FindStringSubmatch(line); len(matches) > 0 {
+				effort, err := util.ParseDuration(matches[1])
+				if err == nil {
+					currentTask.Duration = effort
+				}
 			}
 		}
 
@@ -98,6 +120,18 @@ func Parse(r io.Reader, source string) ([]model.Task, error) {
 	return tasks, nil
 }
 
+// parseTimestamp parses the date and the optional time of day of an Org-mode
+// timestamp. Without a time of day, the timestamp is at local midnight and
+// allDay is true.
+func parseTimestamp(date, clock string) (t time.Time, allDay bool, err error) {
+	if clock == "" {
+		t, err = time.ParseInLocation("2006-01-02", date, time.Local)
+		return t, true, err
+	}
+	t, err = time.ParseInLocation("2006-01-02 15:04", date+" "+clock, time.Local)
+	return t, false, err
+}
+
 // FilterTasks filters a slice of tasks by a given filter string.
 // Currently, it only supports filtering by a single tag.
 func FilterTasks(tasks []model.Task, filter string) []model.Task {
@@ -0,0 +1,370 @@
+package orgmode
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/internal/fsutil"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+	"github.com/google/uuid"
+)
+
+const (
+	// Keywords of the planning line that follows a heading
+	DEADLINE  = "DEADLINE"
+	SCHEDULED = "SCHEDULED"
+	CLOSED    = "CLOSED"
+
+	activeTimestampLayout   = "2006-01-02 Mon 15:04"
+	activeDateLayout        = "2006-01-02 Mon"
+	inactiveTimestampLayout = "[2006-01-02 Mon 15:04]"
+)
+
+var (
+	anyHeadingRegex = regexp.MustCompile(`^\*+\s`)
+	headingRegex    = regexp.MustCompile(`^(\*+\s+)(TODO|DONE)(\s+(?:\[#[A-Z]\]\s*)?)(.*?)(\s+:[\w@#%:]+:)?(\s*)$`)
+	planningRegex   = regexp.MustCompile(`^\s*(DEADLINE|SCHEDULED|CLOSED):`)
+	idLineRegex     = regexp.MustCompile(`^\s*:ID:\s+(\S+)\s*$`)
+	effortLineRegex = regexp.MustCompile(`(?i)^(\s*:EFFORT:\s+)\S+(.*)$`)
+	// The repeater and warning delay of a timestamp, e.g. "+1w" or "-2d"
+	timestampSuffixRegex = regexp.MustCompile(`((?:\s+[.+]?\+\d+[hdwmy])?(?:\s+-{1,2}\d+[hdwmy])?)>`)
+)
+
+// Writer updates Org-mode files in place. Every byte of the file that is not
+// part of the change is preserved.
+type Writer struct{}
+
+// NewWriter creates a new Org-mode writer.
+func NewWriter() *Writer {
+	return &Writer{}
+}
+
+// WriteBack implements model.Writer, applying the calendar-side changes to
+// the heading with the task ID in the file the task was read from.
+func (w *Writer) WriteBack(task model.Task, fields []string) error {
+	var unsupported error
+	err := updateFile(task.Source, func(content []byte) ([]byte, error) {
+		var err error
+		for _, field := range fields {
+			switch field {
+			case util.TIMING_DUE:
+				content, err = SetTimestamp(content, task.ID, DEADLINE, task.Deadline, !task.AllDay)
+			case util.TIMING_SCHEDULED:
+				content, err = SetTimestamp(content, task.ID, SCHEDULED, task.Scheduled, !task.AllDay)
+			case util.TIMING_DURATION:
+				content, err = SetEffort(content, task.ID, task.Duration)
+			case util.NEEDS_UPDATE_DESCRIPTION:
+				content, err = SetTitle(content, task.ID, task.Description)
+			case util.NEEDS_UPDATE_STATUS:
+				switch task.Status {
+				case "completed":
+					content, err = MarkDone(content, task.ID, time.Now())
+				case "pending":
+					content, err = MarkTodo(content, task.ID)
+				default:
+					unsupported = fmt.Errorf("Org-mode has no '%s' state: %w", task.Status, model.ErrStatusUnsupported)
+				}
+			default:
+				err = fmt.Errorf("field '%s' cannot be written back to Org-mode", field)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return content, nil
+	})
+	if err != nil {
+		return err
+	}
+	return unsupported
+}
+
+// AssignIDs adds an :ID: property to every TODO or DONE heading of the file
+// that has a DEADLINE but no ID yet, so that it can be synchronized. It
+// returns the number of headings that were changed.
+func AssignIDs(filePath string) (int, error) {
+	count := 0
+	err := updateFile(filePath, func(content []byte) ([]byte, error) {
+		lines := splitLines(content)
+		for i := 0; i < len(lines); i++ {
+			if !headingRegex.MatchString(trimEOL(lines[i])) {
+				continue
+			}
+			end := sectionEnd(lines, i)
+			if !hasDeadline(lines, i) || findID(lines, i, end) != "" {
+				continue
+			}
+			lines = insertID(lines, i, uuid.NewString())
+			count++
+		}
+		return joinLines(lines), nil
+	})
+	return count, err
+}
+
+// SetTimestamp sets the DEADLINE or SCHEDULED timestamp of the heading with
+// the given ID. An existing repeater or warning delay is kept.
+func SetTimestamp(content []byte, id, keyword string, t time.Time, withTime bool) ([]byte, error) {
+	lines := splitLines(content)
+	heading, err := findHeading(lines, id)
+	if err != nil {
+		return nil, err
+	}
+
+	layout := activeDateLayout
+	if withTime {
+		layout = activeTimestampLayout
+	}
+	stamp := t.In(time.Local).Format(layout)
+
+	keywordRegex := regexp.MustCompile(keyword + `:\s*<[^>]*>`)
+	planning := heading + 1
+	if planning < len(lines) && planningRegex.MatchString(lines[planning]) {
+		line := lines[planning]
+		if loc := keywordRegex.FindStringIndex(line); loc != nil {
+			old := line[loc[0]:loc[1]]
+			suffix := ""
+			if m := timestampSuffixRegex.FindStringSubmatch(old); m != nil {
+				suffix = m[1]
+			}
+			lines[planning] = line[:loc[0]] + fmt.Sprintf("%s: <%s%s>", keyword, stamp, suffix) + line[loc[1]:]
+		} else {
+			body, eol := splitEOL(line)
+			lines[planning] = fmt.Sprintf("%s %s: <%s>%s", body, keyword, stamp, eol)
+		}
+	} else {
+		lines = insertLine(lines, planning, fmt.Sprintf("%s: <%s>", keyword, stamp))
+	}
+	return joinLines(lines), nil
+}
+
+// SetEffort sets the :EFFORT: property of the heading with the given ID, e.g.
+// to 1:30.
+func SetEffort(content []byte, id string, effort time.Duration) ([]byte, error) {
+	lines := splitLines(content)
+	heading, err := findHeading(lines, id)
+	if err != nil {
+		return nil, err
+	}
+
+	effort = effort.Round(time.Minute)
+	value := fmt.Sprintf("%d:%02d", effort/time.Hour, (effort%time.Hour)/time.Minute)
+	end := sectionEnd(lines, heading)
+	for i := heading + 1; i < end; i++ {
+		body, eol := splitEOL(lines[i])
+		if m := effortLineRegex.FindStringSubmatch(body); m != nil {
+			lines[i] = m[1] + value + m[2] + eol
+			return joinLines(lines), nil
+		}
+	}
+	// The drawer holding the ID gets the new property
+	for i := heading + 1; i < end; i++ {
+		body := trimEOL(lines[i])
+		if idLineRegex.MatchString(body) {
+			indent := body[:len(body)-len(strings.TrimLeft(body, " \t"))]
+			return joinLines(insertLine(lines, i+1, indent+":EFFORT: "+value)), nil
+		}
+	}
+	return nil, fmt.Errorf("no property drawer in heading with ID '%s'", id)
+}
+
+// MarkDone switches the heading with the given ID from TODO to DONE and adds
+// a CLOSED timestamp to its planning line.
+func MarkDone(content []byte, id string, closed time.Time) ([]byte, error) {
+	lines := splitLines(content)
+	heading, err := findHeading(lines, id)
+	if err != nil {
+		return nil, err
+	}
+	matches := headingRegex.FindStringSubmatch(trimEOL(lines[heading]))
+	if matches[2] == "DONE" {
+		return content, nil
+	}
+	lines[heading] = setKeyword(lines[heading], matches, "DONE")
+
+	stamp := fmt.Sprintf("%s: %s", CLOSED, closed.In(time.Local).Format(inactiveTimestampLayout))
+	planning := heading + 1
+	if planning < len(lines) && planningRegex.MatchString(lines[planning]) {
+		// Org puts CLOSED first, right after the indentation
+		line := lines[planning]
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		lines[planning] = line[:indent] + stamp + " " + line[indent:]
+	} else {
+		lines = insertLine(lines, planning, stamp)
+	}
+	return joinLines(lines), nil
+}
+
+// MarkTodo switches the heading with the given ID from DONE back to TODO and
+// removes its CLOSED timestamp.
+func MarkTodo(content []byte, id string) ([]byte, error) {
+	lines := splitLines(content)
+	heading, err := findHeading(lines, id)
+	if err != nil {
+		return nil, err
+	}
+	matches := headingRegex.FindStringSubmatch(trimEOL(lines[heading]))
+	if matches[2] == "TODO" {
+		return content, nil
+	}
+	lines[heading] = setKeyword(lines[heading], matches, "TODO")
+
+	planning := heading + 1
+	if planning < len(lines) && planningRegex.MatchString(lines[planning]) {
+		closedRegex := regexp.MustCompile(CLOSED + `:[ \t]*\[[^\]]*\][ \t]*`)
+		line := closedRegex.ReplaceAllString(lines[planning], "")
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines[:planning], lines[planning+1:]...)
+		} else {
+			lines[planning] = line
+		}
+	}
+	return joinLines(lines), nil
+}
+
+// SetTitle replaces the title of the heading with the given ID, keeping its
+// keyword, priority and tags.
+func SetTitle(content []byte, id, title string) ([]byte, error) {
+	lines := splitLines(content)
+	heading, err := findHeading(lines, id)
+	if err != nil {
+		return nil, err
+	}
+	body, eol := splitEOL(lines[heading])
+	m := headingRegex.FindStringSubmatch(body)
+	lines[heading] = m[1] + m[2] + m[3] + title + m[5] + m[6] + eol
+	return joinLines(lines), nil
+}
+
+// findHeading returns the index of the TODO/DONE heading whose property
+// drawer holds the given ID.
+func findHeading(lines []string, id string) (int, error) {
+	heading := -1
+	for i, line := range lines {
+		line = trimEOL(line)
+		if headingRegex.MatchString(line) {
+			heading = i
+		} else if anyHeadingRegex.MatchString(line) {
+			heading = -1
+		} else if m := idLineRegex.FindStringSubmatch(line); m != nil && m[1] == id && heading >= 0 {
+			return heading, nil
+		}
+	}
+	return -1, fmt.Errorf("no TODO or DONE heading with ID '%s'", id)
+}
+
+// sectionEnd returns the index of the line following the heading section.
+func sectionEnd(lines []string, heading int) int {
+	for i := heading + 1; i < len(lines); i++ {
+		if anyHeadingRegex.MatchString(lines[i]) {
+			return i
+		}
+	}
+	return len(lines)
+}
+
+// findID returns the :ID: property of the heading, if any.
+func findID(lines []string, heading, end int) string {
+	for i := heading + 1; i < end; i++ {
+		if m := idLineRegex.FindStringSubmatch(trimEOL(lines[i])); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// hasDeadline reports whether the heading planning line has a DEADLINE.
+func hasDeadline(lines []string, heading int) bool {
+	planning := heading + 1
+	return planning < len(lines) && planningRegex.MatchString(lines[planning]) &&
+		strings.Contains(lines[planning], DEADLINE+":")
+}
+
+// insertID adds the ID to the heading property drawer, creating the drawer
+// after the planning line when missing.
+func insertID(lines []string, heading int, id string) []string {
+	pos := heading + 1
+	if pos < len(lines) && planningRegex.MatchString(lines[pos]) {
+		pos++
+	}
+	if pos < len(lines) && strings.TrimSpace(lines[pos]) == ":PROPERTIES:" {
+		return insertLine(lines, pos+1, ":ID: "+id)
+	}
+	lines = insertLine(lines, pos, ":END:")
+	lines = insertLine(lines, pos, ":ID: "+id)
+	return insertLine(lines, pos, ":PROPERTIES:")
+}
+
+// setKeyword replaces the TODO keyword of a heading line.
+func setKeyword(line string, matches []string, keyword string) string {
+	return strings.Replace(line, matches[1]+matches[2], matches[1]+keyword, 1)
+}
+
+// insertLine inserts text at index pos, using the line ending of the file.
+func insertLine(lines []string, pos int, text string) []string {
+	eol := "\n"
+	if len(lines) > 0 && strings.HasSuffix(lines[0], "\r\n") {
+		eol = "\r\n"
+	}
+	text += eol
+	// The last line of the file might lack a line ending: the appended line
+	// takes its place as the last one
+	if pos > 0 && pos == len(lines) && !strings.HasSuffix(lines[pos-1], "\n") {
+		lines[pos-1] += eol
+		text = strings.TrimSuffix(text, eol)
+	}
+	lines = append(lines, "")
+	copy(lines[pos+1:], lines[pos:])
+	lines[pos] = text
+	return lines
+}
+
+// splitLines splits the content keeping the line endings, so that joining
+// the lines gives back the exact same bytes.
+func splitLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func joinLines(lines []string) []byte {
+	return []byte(strings.Join(lines, ""))
+}
+
+// splitEOL splits a line into its body and its line ending.
+func splitEOL(line string) (string, string) {
+	body := trimEOL(line)
+	return body, line[len(body):]
+}
+
+func trimEOL(line string) string {
+	return strings.TrimRight(line, "\r\n")
+}
+
+// updateFile applies change to the content of the file, replacing it
+// atomically and keeping its permissions.
+func updateFile(filePath string, change func([]byte) ([]byte, error)) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	updated, err := change(content)
+	if err != nil {
+		return fmt.Errorf("unable to update %s: %w", filePath, err)
+	}
+	if string(updated) == string(content) {
+		return nil
+	}
+
+	return fsutil.WriteFileAtomic(filePath, updated, info.Mode().Perm())
+}
@@ -0,0 +1,278 @@
+package orgmode
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+)
+
+// drawer is the property drawer of the heading with ID "a".
+const drawer = ":PROPERTIES:\n:ID: a\n:END:\n"
+
+// crlf converts the line endings of text to CRLF.
+func crlf(text string) string {
+	return strings.ReplaceAll(text, "\n", "\r\n")
+}
+
+func TestSetTimestamp(t *testing.T) {
+	at := time.Date(2025, 6, 1, 9, 0, 0, 0, time.Local)
+	tests := []struct {
+		name     string
+		content  string
+		keyword  string
+		withTime bool
+		want     string
+	}{
+		{
+			name:     "planning line inserted",
+			content:  "* TODO Task\n" + drawer,
+			keyword:  DEADLINE,
+			withTime: true,
+			want:     "* TODO Task\nDEADLINE: <2025-06-01 Sun 09:00>\n" + drawer,
+		},
+		{
+			name:    "keyword added to the planning line",
+			content: "* TODO Task\n  SCHEDULED: <2025-05-30 Fri>\n" + drawer,
+			keyword: DEADLINE,
+			want:    "* TODO Task\n  SCHEDULED: <2025-05-30 Fri> DEADLINE: <2025-06-01 Sun>\n" + drawer,
+		},
+		{
+			name:     "timestamp replaced",
+			content:  "* TODO Task\nDEADLINE: <2025-05-01 Thu 10:00> SCHEDULED: <2025-04-30 Wed>\n" + drawer,
+			keyword:  DEADLINE,
+			withTime: true,
+			want:     "* TODO Task\nDEADLINE: <2025-06-01 Sun 09:00> SCHEDULED: <2025-04-30 Wed>\n" + drawer,
+		},
+		{
+			name:     "repeater kept",
+			content:  "* TODO Task\nDEADLINE: <2025-05-01 Thu 10:00 +1w>\n" + drawer,
+			keyword:  DEADLINE,
+			withTime: true,
+			want:     "* TODO Task\nDEADLINE: <2025-06-01 Sun 09:00 +1w>\n" + drawer,
+		},
+		{
+			name:    "repeater and warning delay kept",
+			content: "* TODO Task\nSCHEDULED: <2025-05-01 Thu .+2d -3d>\n" + drawer,
+			keyword: SCHEDULED,
+			want:    "* TODO Task\nSCHEDULED: <2025-06-01 Sun .+2d -3d>\n" + drawer,
+		},
+		{
+			name:     "CRLF",
+			content:  crlf("* TODO Task\n" + drawer),
+			keyword:  DEADLINE,
+			withTime: true,
+			want:     crlf("* TODO Task\nDEADLINE: <2025-06-01 Sun 09:00>\n" + drawer),
+		},
+		{
+			name:     "no final newline",
+			content:  "* TODO Task\nDEADLINE: <2025-05-01 Thu>\n:PROPERTIES:\n:ID: a\n:END:",
+			keyword:  DEADLINE,
+			withTime: true,
+			want:     "* TODO Task\nDEADLINE: <2025-06-01 Sun 09:00>\n:PROPERTIES:\n:ID: a\n:END:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SetTimestamp([]byte(tt.content), "a", tt.keyword, at, tt.withTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkDoneAndTodo(t *testing.T) {
+	closed := time.Date(2025, 6, 1, 10, 30, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		todo string
+		done string
+	}{
+		{
+			name: "CLOSED line",
+			todo: "* TODO Task\n" + drawer,
+			done: "* DONE Task\nCLOSED: [2025-06-01 Sun 10:30]\n" + drawer,
+		},
+		{
+			name: "CLOSED in the planning line",
+			todo: "** TODO [#A] Task :work:\n   DEADLINE: <2025-06-01 Sun>\n" + drawer,
+			done: "** DONE [#A] Task :work:\n   CLOSED: [2025-06-01 Sun 10:30] DEADLINE: <2025-06-01 Sun>\n" + drawer,
+		},
+		{
+			name: "CRLF",
+			todo: crlf("* TODO Task\nSCHEDULED: <2025-05-30 Fri>\n" + drawer),
+			done: crlf("* DONE Task\nCLOSED: [2025-06-01 Sun 10:30] SCHEDULED: <2025-05-30 Fri>\n" + drawer),
+		},
+		{
+			name: "no final newline",
+			todo: "* TODO Task\n:PROPERTIES:\n:ID: a\n:END:",
+			done: "* DONE Task\nCLOSED: [2025-06-01 Sun 10:30]\n:PROPERTIES:\n:ID: a\n:END:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done, err := MarkDone([]byte(tt.todo), "a", closed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(done) != tt.done {
+				t.Errorf("MarkDone: got\n%q\nwant\n%q", done, tt.done)
+			}
+			todo, err := MarkTodo([]byte(tt.done), "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(todo) != tt.todo {
+				t.Errorf("MarkTodo: got\n%q\nwant\n%q", todo, tt.todo)
+			}
+		})
+	}
+}
+
+func TestSetEffort(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "property replaced",
+			content: "* TODO Task\n  :PROPERTIES:\n  :Effort:   0:30\n  :ID: a\n  :END:\n",
+			want:    "* TODO Task\n  :PROPERTIES:\n  :Effort:   1:30\n  :ID: a\n  :END:\n",
+		},
+		{
+			name:    "property added to the drawer",
+			content: "* TODO Task\n  :PROPERTIES:\n  :ID: a\n  :END:\n",
+			want:    "* TODO Task\n  :PROPERTIES:\n  :ID: a\n  :EFFORT: 1:30\n  :END:\n",
+		},
+		{
+			name:    "CRLF",
+			content: crlf("* TODO Task\n" + drawer),
+			want:    crlf("* TODO Task\n:PROPERTIES:\n:ID: a\n:EFFORT: 1:30\n:END:\n"),
+		},
+		{
+			name:    "unknown ID",
+			content: "* TODO Task\n:PROPERTIES:\n:ID: b\n:END:\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SetEffort([]byte(tt.content), "a", 90*time.Minute)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("got\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetTitle(t *testing.T) {
+	content := "* TODO [#B] Old title   :work:home:\n" + drawer
+	got, err := SetTitle([]byte(content), "a", "New title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "* TODO [#B] New title   :work:home:\n" + drawer; string(got) != want {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+}
+
+// generatedID matches the IDs added by AssignIDs.
+var generatedID = regexp.MustCompile(`:ID: [0-9a-f-]{36}`)
+
+func TestAssignIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		count   int
+	}{
+		{
+			name:    "property drawer created",
+			content: "* TODO Task\nDEADLINE: <2025-06-01 Sun>\nSome notes\n",
+			want:    "* TODO Task\nDEADLINE: <2025-06-01 Sun>\n:PROPERTIES:\n:ID: new\n:END:\nSome notes\n",
+			count:   1,
+		},
+		{
+			name:    "ID added to the drawer",
+			content: "* DONE Task\nDEADLINE: <2025-06-01 Sun>\n:PROPERTIES:\n:CATEGORY: work\n:END:\n",
+			want:    "* DONE Task\nDEADLINE: <2025-06-01 Sun>\n:PROPERTIES:\n:ID: new\n:CATEGORY: work\n:END:\n",
+			count:   1,
+		},
+		{
+			name:    "headings without deadline or with an ID left alone",
+			content: "* TODO No deadline\n* TODO Task\nDEADLINE: <2025-06-01 Sun>\n" + drawer,
+			want:    "* TODO No deadline\n* TODO Task\nDEADLINE: <2025-06-01 Sun>\n" + drawer,
+		},
+		{
+			name:    "CRLF",
+			content: crlf("* TODO Task\nDEADLINE: <2025-06-01 Sun>\n"),
+			want:    crlf("* TODO Task\nDEADLINE: <2025-06-01 Sun>\n:PROPERTIES:\n:ID: new\n:END:\n"),
+			count:   1,
+		},
+		{
+			name:    "no final newline",
+			content: "* TODO Task\nDEADLINE: <2025-06-01 Sun>",
+			want:    "* TODO Task\nDEADLINE: <2025-06-01 Sun>\n:PROPERTIES:\n:ID: new\n:END:",
+			count:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tasks.org")
+			if err := os.WriteFile(path, []byte(tt.content), 0640); err != nil {
+				t.Fatal(err)
+			}
+			count, err := AssignIDs(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := generatedID.ReplaceAllString(string(content), ":ID: new")
+			if count != tt.count || got != tt.want {
+				t.Errorf("got %d IDs in\n%q\nwant %d in\n%q", count, got, tt.count, tt.want)
+			}
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+				t.Errorf("file permissions not kept: %v %v", info.Mode(), err)
+			}
+		})
+	}
+}
+
+func TestWriteBackDeleted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.org")
+	if err := os.WriteFile(path, []byte("* TODO Task\n"+drawer), 0600); err != nil {
+		t.Fatal(err)
+	}
+	task := model.Task{ID: "a", Description: "Renamed", Status: "deleted", Source: path}
+
+	err := NewWriter().WriteBack(task, []string{util.NEEDS_UPDATE_STATUS, util.NEEDS_UPDATE_DESCRIPTION})
+	if !errors.Is(err, model.ErrStatusUnsupported) {
+		t.Errorf("got error %v, want %v", err, model.ErrStatusUnsupported)
+	}
+	// The other fields are written anyway
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "* TODO Renamed\n" + drawer; string(content) != want {
+		t.Errorf("got\n%q\nwant\n%q", content, want)
+	}
+}
@@ -0,0 +1,70 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/orgmode"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+)
+
+// Orgmode is the name of the Org-mode source.
+const Orgmode = "orgmode"
+
+func init() {
+	Register(Orgmode, newOrgmodeSource)
+}
+
+// orgmodeSource reads the tasks of Org-mode files. The embedded writer
+// writes the changes back.
+type orgmodeSource struct {
+	*orgmode.Writer
+	files []string
+}
+
+func newOrgmodeSource(opts Options) (Source, error) {
+	if len(opts.Files) == 0 {
+		return nil, fmt.Errorf("no Org-mode files specified in the configuration file")
+	}
+	if opts.TwoWay {
+		// Changes can be written back only to headings with an ID
+		for _, file := range opts.Files {
+			count, err := orgmode.AssignIDs(file)
+			if err != nil {
+				return nil, fmt.Errorf("unable to add IDs to Org-mode file %s: %w", file, err)
+			}
+			if count > 0 {
+				log.Printf("Added an ID to %d headings in %s", count, file)
+			}
+		}
+	}
+	return &orgmodeSource{Writer: orgmode.NewWriter(), files: opts.Files}, nil
+}
+
+func (s *orgmodeSource) Fetch(ctx context.Context, filter string) ([]model.Task, error) {
+	tasks, err := orgmode.ParseFiles(s.files)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse Org-mode files: %w", err)
+	}
+	if filter != "" {
+		tasks = orgmode.FilterTasks(tasks, filter)
+	}
+	for i := range tasks {
+		tasks[i].Scope = util.TaskScope(tasks[i].Source, filter)
+	}
+	return tasks, nil
+}
+
+func (s *orgmodeSource) Scopes(filter string) []string {
+	var scopes []string
+	for _, file := range s.files {
+		scopes = append(scopes, util.TaskScope(file, filter))
+	}
+	return scopes
+}
+
+func (s *orgmodeSource) WatchPaths() ([]string, error) {
+	return s.files, nil
+}
@@ -0,0 +1,84 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+)
+
+// Source reads the tasks to sync from a task manager.
+//
+// Sources that can apply the calendar-side changes back to their tasks also
+// implement model.Writer.
+type Source interface {
+	// Fetch returns the tasks selected by filter, with their Scope set.
+	Fetch(ctx context.Context, filter string) ([]model.Task, error)
+	// Scopes returns the scopes of the tasks selected by filter, including
+	// the ones that currently have no tasks, so that their events can be
+	// pruned.
+	Scopes(filter string) []string
+}
+
+// Watcher is implemented by the sources that can tell where their tasks are
+// stored, so that sync --watch can follow the changes to them.
+type Watcher interface {
+	// WatchPaths returns the files and directories holding the tasks.
+	WatchPaths() ([]string, error)
+}
+
+// Options configure a Source.
+type Options struct {
+	// Files are the files to read tasks from, for file based sources.
+	Files []string
+	// Timing tells how tasks are placed in the calendar.
+	Timing util.TimingRules
+	// TwoWay prepares the source for writing changes back, e.g. by adding
+	// the missing task IDs.
+	TwoWay bool
+}
+
+// Factory creates a Source with the given options.
+type Factory func(opts Options) (Source, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a source available by name. It is meant to be called from
+// the init function of the source implementation.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("source '%s' registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// New creates the source registered with the given name.
+func New(name string, opts Options) (Source, error) {
+	mu.RLock()
+	factory, ok := factories[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown source '%s', available sources: %v", name, Names())
+	}
+	return factory(opts)
+}
+
+// Names returns the names of the registered sources, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,104 @@
+package source
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/taskwarrior"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+)
+
+// Taskwarrior is the name of the Taskwarrior source.
+const Taskwarrior = "taskwarrior"
+
+func init() {
+	Register(Taskwarrior, func(opts Options) (Source, error) {
+		client := taskwarrior.NewClient()
+		client.DurationUDA = opts.Timing.DurationUDA
+		return &taskwarriorSource{Client: client, timing: opts.Timing}, nil
+	})
+}
+
+// taskwarriorSource reads tasks with the task command. The embedded client
+// writes the changes back.
+type taskwarriorSource struct {
+	*taskwarrior.Client
+	timing util.TimingRules
+}
+
+func (s *taskwarriorSource) Fetch(ctx context.Context, filter string) ([]model.Task, error) {
+	twTasks, err := s.GetTasks(strings.Fields(filter))
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []model.Task
+	for _, t := range twTasks {
+		tasks = append(tasks, s.convert(t, filter))
+	}
+	// Recurring templates become a single recurring event
+	return util.GroupRecurring(tasks), nil
+}
+
+func (s *taskwarriorSource) Scopes(filter string) []string {
+	return []string{util.TaskScope(Taskwarrior, filter)}
+}
+
+func (s *taskwarriorSource) WatchPaths() ([]string, error) {
+	dir, err := s.DataLocation()
+	if err != nil {
+		return nil, err
+	}
+	return []string{dir}, nil
+}
+
+// convert returns the model.Task of a Taskwarrior task.
+func (s *taskwarriorSource) convert(t taskwarrior.Task, filter string) model.Task {
+	var duration time.Duration
+	if value, ok := t.UDA(s.timing.DurationUDA); ok && s.timing.DurationUDA != "" {
+		var err error
+		duration, err = util.ParseDuration(value)
+		if err != nil {
+			log.Printf("Ignoring %s of task '%s': %v", s.timing.DurationUDA, t.Description, err)
+		}
+	}
+
+	// Taskwarrior has no date-only dates: due at midnight is a whole day
+	allDay := util.IsMidnight(timeOf(t.Due))
+	recurrence, completed, err := t.Recurrence(allDay)
+	if err != nil {
+		log.Printf("Ignoring recurrence of task '%s': %v", t.Description, err)
+	}
+
+	return model.Task{
+		ID:                 t.UUID,
+		Description:        t.Description,
+		Deadline:           timeOf(t.Due),
+		Status:             t.Status,
+		Project:            t.Project,
+		Tags:               t.Tags,
+		Priority:           t.Priority,
+		Source:             Taskwarrior,
+		Scope:              util.TaskScope(Taskwarrior, filter),
+		Modified:           timeOf(t.Modified),
+		Scheduled:          timeOf(t.Scheduled),
+		Wait:               timeOf(t.Wait),
+		Until:              timeOf(t.Until),
+		Duration:           duration,
+		AllDay:             allDay,
+		Recurrence:         recurrence,
+		CompletedInstances: completed,
+		Parent:             t.Parent,
+	}
+}
+
+// timeOf returns the time of a Taskwarrior date, or the zero time if unset.
+func timeOf(t *taskwarrior.CustomTime) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.Time
+}
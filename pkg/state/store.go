@@ -0,0 +1,217 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/internal/fsutil"
+)
+
+// StateFile is the name of the file, stored next to token.json, that keeps
+// track of which calendar event belongs to which task.
+const StateFile = "state.json"
+
+// Mapping links a task to the calendar event created for it.
+type Mapping struct {
+	TaskID     string    `json:"task_id"`
+	CalendarID string    `json:"calendar_id"`
+	EventID    string    `json:"event_id"`
+	ETag       string    `json:"etag,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	LastSynced time.Time `json:"last_synced"`
+	// Scope is the source and filter scope the event was created for.
+	Scope string `json:"scope,omitempty"`
+	// OrphanedSince is set the first time a sync of Scope no longer returns
+	// the task. The event is pruned once the grace period has elapsed.
+	OrphanedSince *time.Time `json:"orphaned_since,omitempty"`
+}
+
+// CalendarCache is the local copy of the events of a calendar, kept up to
+// date with incremental reads.
+type CalendarCache struct {
+	// SyncToken is used to read only the changes since the last read. It is empty
+	// until the first full read.
+	SyncToken string `json:"sync_token,omitempty"`
+	// Events are the raw API events, by event ID.
+	Events map[string]json.RawMessage `json:"events,omitempty"`
+}
+
+// Store is a JSON file backed map of task ID to Mapping.
+type Store struct {
+	path string
+	mu   sync.Mutex
+
+	Mappings  map[string]*Mapping       `json:"mappings"`
+	Calendars map[string]*CalendarCache `json:"calendars,omitempty"`
+}
+
+// Load reads the store from path. A missing file results in an empty store.
+func Load(path string) (*Store, error) {
+	s := &Store{path: path, Mappings: make(map[string]*Mapping), Calendars: make(map[string]*CalendarCache)}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unable to read state file %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("unable to parse state file %s: %w", path, err)
+	}
+	if s.Mappings == nil {
+		s.Mappings = make(map[string]*Mapping)
+	}
+	if s.Calendars == nil {
+		s.Calendars = make(map[string]*CalendarCache)
+	}
+	return s, nil
+}
+
+// Lock waits until no other process is syncing, and takes its place: the
+// hooks, a sync --watch and a sync run by cron all share the state file. The
+// store is read again from the file, so that the changes other processes
+// saved in the meantime are not overwritten. The lock must be held from
+// before the store is used until after Save. The returned function releases
+// it.
+func (s *Store) Lock() (func(), error) {
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create state directory %s: %w", dir, err)
+	}
+	unlock, err := fsutil.LockFile(s.path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := Load(s.path)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	s.mu.Lock()
+	s.Mappings, s.Calendars = current.Mappings, current.Calendars
+	s.mu.Unlock()
+	return unlock, nil
+}
+
+// Get returns a copy of the mapping for the given task, if any.
+func (s *Store) Get(taskID string) (Mapping, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.Mappings[taskID]
+	if !ok {
+		return Mapping{}, false
+	}
+	return *m, true
+}
+
+// Put adds or replaces the mapping for m.TaskID.
+func (s *Store) Put(m Mapping) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Mappings[m.TaskID] = &m
+}
+
+// Delete removes the mapping for the given task.
+func (s *Store) Delete(taskID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Mappings, taskID)
+}
+
+// List returns a copy of all the mappings.
+func (s *Store) List() []Mapping {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mappings := make([]Mapping, 0, len(s.Mappings))
+	for _, m := range s.Mappings {
+		mappings = append(mappings, *m)
+	}
+	return mappings
+}
+
+// Cache returns a copy of the cached events of the calendar and the sync
+// token to read the changes made since they were cached.
+func (s *Store) Cache(calendarID string) (syncToken string, events map[string]json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events = make(map[string]json.RawMessage)
+	cache, ok := s.Calendars[calendarID]
+	if !ok {
+		return "", events
+	}
+	for id, event := range cache.Events {
+		events[id] = event
+	}
+	return cache.SyncToken, events
+}
+
+// PutEvent adds or replaces a cached event of the calendar. A nil event
+// removes it from the cache.
+func (s *Store) PutEvent(calendarID, eventID string, event json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cache := s.calendar(calendarID)
+	if event == nil {
+		delete(cache.Events, eventID)
+		return
+	}
+	cache.Events[eventID] = event
+}
+
+// SetSyncToken records the token returned by the last read of the calendar.
+func (s *Store) SetSyncToken(calendarID, syncToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calendar(calendarID).SyncToken = syncToken
+}
+
+// ResetCache drops the cached events and the sync token of the calendar,
+// e.g. when the server no longer accepts the token.
+func (s *Store) ResetCache(calendarID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Calendars, calendarID)
+}
+
+// calendar returns the cache of the calendar, creating it if needed. The
+// caller must hold the lock.
+func (s *Store) calendar(calendarID string) *CalendarCache {
+	cache, ok := s.Calendars[calendarID]
+	if !ok {
+		cache = &CalendarCache{}
+		s.Calendars[calendarID] = cache
+	}
+	if cache.Events == nil {
+		cache.Events = make(map[string]json.RawMessage)
+	}
+	return cache
+}
+
+// Save writes the store back to disk. The file is written to a temporary
+// location first and then renamed, so that an interrupted sync never leaves
+// a truncated state file behind.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	b, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to encode state: %w", err)
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to create state directory %s: %w", dir, err)
+	}
+
+	if err := fsutil.WriteFileAtomic(s.path, b, 0600); err != nil {
+		return fmt.Errorf("unable to write state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockReadsChangesOfOtherProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), StateFile)
+	// Two stores loaded from the same file, as by two processes
+	first, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := first.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Put(Mapping{TaskID: "task-1", EventID: "event-1"})
+
+	locked := make(chan func())
+	go func() {
+		unlock, err := second.Lock()
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("second store locked while the first one held the lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := first.Save(); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+
+	unlockSecond := <-locked
+	defer unlockSecond()
+	if m, ok := second.Get("task-1"); !ok || m.EventID != "event-1" {
+		t.Errorf("second store did not read the mapping saved by the first one: %+v", m)
+	}
+	second.Put(Mapping{TaskID: "task-2", EventID: "event-2"})
+	if err := second.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Mappings) != 2 {
+		t.Errorf("got %d mappings saved, want 2", len(saved.Mappings))
+	}
+}
@@ -3,10 +3,21 @@ package taskwarrior
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
 )
 
-type Client struct{}
+type Client struct {
+	// DurationUDA is the UDA the task duration is written back to, if any.
+	DurationUDA string
+}
 
 func NewClient() *Client {
 	return &Client{}
@@ -14,6 +25,150 @@ func NewClient() *Client {
 
 func (c *Client) GetTasks(filter []string) ([]Task, error) {
 	args := append(filter, "export", "rc.hooks=0")
+	output, err := run(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []Task
+	if err := json.Unmarshal(output, &tasks); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal taskwarrior output: %w", err)
+	}
+	return tasks, nil
+}
+
+// ModifyTask applies the modifications (e.g. "due:2025-06-01T09:00:00Z") to
+// the task with the given UUID.
+func (c *Client) ModifyTask(uuid string, mods ...string) error {
+	args := append([]string{"rc.confirmation=off", "rc.hooks=0", uuid, "modify"}, mods...)
+	_, err := run(args...)
+	return err
+}
+
+// CompleteTask marks the task with the given UUID as done.
+func (c *Client) CompleteTask(uuid string) error {
+	_, err := run("rc.confirmation=off", "rc.hooks=0", uuid, "done")
+	return err
+}
+
+// DeleteTask marks the task with the given UUID as deleted.
+func (c *Client) DeleteTask(uuid string) error {
+	_, err := run("rc.confirmation=off", "rc.hooks=0", uuid, "delete")
+	return err
+}
+
+// WriteBack implements model.Writer, applying the calendar-side changes to
+// the Taskwarrior task.
+func (c *Client) WriteBack(task model.Task, fields []string) error {
+	var mods []string
+	var status string
+	for _, field := range fields {
+		switch field {
+		case util.TIMING_DUE:
+			mods = append(mods, "due:"+formatDate(task.Deadline, task.AllDay))
+		case util.TIMING_SCHEDULED:
+			mods = append(mods, "scheduled:"+formatDate(task.Scheduled, task.AllDay))
+		case util.TIMING_WAIT:
+			mods = append(mods, "wait:"+formatDate(task.Wait, task.AllDay))
+		case util.TIMING_UNTIL:
+			mods = append(mods, "until:"+formatDate(task.Until, task.AllDay))
+		case util.TIMING_DURATION:
+			if c.DurationUDA == "" {
+				log.Printf("No duration UDA to write the new duration of task %s to, set timing.duration_uda", task.Description)
+				continue
+			}
+			mods = append(mods, c.DurationUDA+":"+formatDuration(task.Duration))
+		case util.NEEDS_UPDATE_DESCRIPTION:
+			mods = append(mods, "description:"+task.Description)
+		case util.NEEDS_UPDATE_STATUS:
+			status = task.Status
+		default:
+			return fmt.Errorf("field '%s' cannot be written back to Taskwarrior", field)
+		}
+	}
+
+	if status == PENDING {
+		mods = append(mods, "status:pending")
+	}
+	if len(mods) > 0 {
+		if err := c.ModifyTask(task.ID, mods...); err != nil {
+			return err
+		}
+	}
+
+	switch status {
+	case COMPLETED:
+		return c.CompleteTask(task.ID)
+	case DELETED:
+		return c.DeleteTask(task.ID)
+	}
+	return nil
+}
+
+// formatDate returns a date as accepted by the task command: a local date
+// for all-day tasks, a UTC time otherwise.
+func formatDate(t time.Time, allDay bool) string {
+	if allDay {
+		return t.In(time.Local).Format("2006-01-02")
+	}
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// formatDuration returns an ISO 8601 duration, e.g. PT1H30M, as Taskwarrior
+// exports them.
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	s := "P"
+	if days > 0 {
+		s += fmt.Sprintf("%dD", days)
+	}
+	if d > 0 || days == 0 {
+		s += "T"
+		if h := d / time.Hour; h > 0 {
+			s += fmt.Sprintf("%dH", h)
+		}
+		if m := (d % time.Hour) / time.Minute; m > 0 || d < time.Hour {
+			s += fmt.Sprintf("%dM", m)
+		}
+	}
+	return s
+}
+
+// DataLocation returns the directory where Taskwarrior keeps the tasks.
+func (c *Client) DataLocation() (string, error) {
+	return location("data.location")
+}
+
+// HooksLocation returns the directory Taskwarrior runs the hooks from.
+func (c *Client) HooksLocation() (string, error) {
+	return location("hooks.location")
+}
+
+// location returns the directory set by the given configuration variable,
+// with the leading ~ expanded.
+func location(name string) (string, error) {
+	output, err := run("rc.hooks=0", "_get", "rc."+name)
+	if err != nil {
+		return "", err
+	}
+	dir := strings.TrimSpace(string(output))
+	if dir == "" {
+		return "", fmt.Errorf("taskwarrior %s is not set", name)
+	}
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("unable to expand taskwarrior %s %s: %w", name, dir, err)
+		}
+		dir = filepath.Join(home, strings.TrimPrefix(dir, "~"))
+	}
+	return dir, nil
+}
+
+// run executes the task command with the given arguments and returns its output.
+func run(args ...string) ([]byte, error) {
 	cmd := exec.Command("task", args...)
 
 	output, err := cmd.Output()
@@ -24,10 +179,5 @@ func (c *Client) GetTasks(filter []string) ([]Task, error) {
 		}
 		return nil, fmt.Errorf("taskwarrior command failed: %w", err)
 	}
-
-	var tasks []Task
-	if err := json.Unmarshal(output, &tasks); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal taskwarrior output: %w", err)
-	}
-	return tasks, nil
+	return output, nil
 }
@@ -1,6 +1,7 @@
 package taskwarrior
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -11,6 +12,7 @@ const (
 	COMPLETED = "completed"
 	WAITING   = "waiting"
 	DELETED   = "deleted"
+	RECURRING = "recurring"
 )
 
 type CustomTime struct {
@@ -48,7 +50,37 @@ type Task struct {
 	Description string      `json:"description"`
 	Due         *CustomTime `json:"due,omitempty"`
 	Scheduled   *CustomTime `json:"scheduled,omitempty"`
+	Wait        *CustomTime `json:"wait,omitempty"`
+	Until       *CustomTime `json:"until,omitempty"`
+	Modified    *CustomTime `json:"modified,omitempty"`
 	Status      string      `json:"status"`
+	Project     string      `json:"project,omitempty"`
+	Tags        []string    `json:"tags,omitempty"`
+	Priority    string      `json:"priority,omitempty"`
+	Recur       string      `json:"recur,omitempty"`
+	Parent      string      `json:"parent,omitempty"`
+	Mask        string      `json:"mask,omitempty"`
 	// Only to update corresponding calendar event
 	EventID string `json:"event_id,omitempty"`
+	// Attributes holds all the exported attributes, including the UDAs
+	Attributes map[string]interface{} `json:"-"`
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface for Task, keeping
+// every attribute in Attributes, since UDAs are user defined.
+func (t *Task) UnmarshalJSON(b []byte) error {
+	type plainTask Task
+	if err := json.Unmarshal(b, (*plainTask)(t)); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &t.Attributes)
+}
+
+// UDA returns the value of the given attribute as a string, if set.
+func (t *Task) UDA(name string) (string, bool) {
+	value, ok := t.Attributes[name]
+	if !ok || value == nil {
+		return "", false
+	}
+	return fmt.Sprint(value), true
 }
@@ -0,0 +1,42 @@
+package taskwarrior
+
+import (
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/util"
+)
+
+// Recurrence returns the RRULE and EXDATE lines of a recurring template task,
+// and the starts of its completed occurrences. Occurrences are tracked by
+// the template mask, one character per generated instance: '-' pending,
+// '+' completed, 'X' deleted and 'W' waiting.
+func (t *Task) Recurrence(allDay bool) ([]string, []time.Time, error) {
+	if t.Status != RECURRING || t.Recur == "" || t.Due == nil {
+		return nil, nil, nil
+	}
+
+	recurrence, err := util.ParseRecur(t.Recur)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var until time.Time
+	if t.Until != nil {
+		until = t.Until.Time
+	}
+	rules := []string{recurrence.RRule(until)}
+
+	// Occurrences are computed in local time, the same way the calendar
+	// expands the recurrence across daylight saving changes
+	start := t.Due.Time.In(time.Local)
+	var completed []time.Time
+	for i, state := range t.Mask {
+		switch state {
+		case 'X':
+			rules = append(rules, util.ExceptionDate(recurrence.Occurrence(start, i), allDay))
+		case '+':
+			completed = append(completed, recurrence.Occurrence(start, i))
+		}
+	}
+	return rules, completed, nil
+}
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"strings"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+)
+
+// FieldChange is a field of a calendar event that the sync would change.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// EventDiff returns the fields of the event that differ from the event the
+// task converts to. A nil event results in the fields of the event that
+// would be created.
+func EventDiff(task *model.Task, event *backend.Event) ([]FieldChange, error) {
+	want, err := ConvertTaskToCalendarEvent(task)
+	if err != nil {
+		return nil, err
+	}
+	if event == nil {
+		event = &backend.Event{}
+	}
+
+	var changes []FieldChange
+	add := func(field, old, new string) {
+		if old != new {
+			changes = append(changes, FieldChange{Field: field, Old: old, New: new})
+		}
+	}
+	add("summary", event.Summary, want.Summary)
+	add("status", event.Status, want.Status)
+	add("start", formatEventTime(event.Start, event.AllDay), formatEventTime(want.Start, want.AllDay))
+	add("end", formatEventTime(event.End, event.AllDay), formatEventTime(want.End, want.AllDay))
+	add("color", event.Color, want.Color)
+	add("recurrence", strings.Join(event.Recurrence, " "), strings.Join(want.Recurrence, " "))
+	for _, key := range []string{PropertyTaskID, PropertySource, PropertyScope, PropertySyncVersion} {
+		add(key, event.Property(key), want.Property(key))
+	}
+	return changes, nil
+}
+
+// formatEventTime returns the date of all-day events, or the time of timed
+// events in UTC, so that the same instant always reads the same.
+func formatEventTime(t time.Time, allDay bool) string {
+	switch {
+	case t.IsZero():
+		return ""
+	case allDay:
+		return t.Format("2006-01-02")
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,211 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+)
+
+// Recurrence is a simple RFC 5545 recurrence: every Interval Freq units,
+// optionally only on weekdays.
+type Recurrence struct {
+	Freq     string // DAILY, WEEKLY, MONTHLY, YEARLY or HOURLY
+	Interval int
+	Weekdays bool
+}
+
+var (
+	recurPeriods = map[string]Recurrence{
+		"hourly":     {Freq: "HOURLY", Interval: 1},
+		"daily":      {Freq: "DAILY", Interval: 1},
+		"day":        {Freq: "DAILY", Interval: 1},
+		"weekdays":   {Freq: "DAILY", Interval: 1, Weekdays: true},
+		"weekly":     {Freq: "WEEKLY", Interval: 1},
+		"week":       {Freq: "WEEKLY", Interval: 1},
+		"biweekly":   {Freq: "WEEKLY", Interval: 2},
+		"fortnight":  {Freq: "WEEKLY", Interval: 2},
+		"monthly":    {Freq: "MONTHLY", Interval: 1},
+		"month":      {Freq: "MONTHLY", Interval: 1},
+		"bimonthly":  {Freq: "MONTHLY", Interval: 2},
+		"quarterly":  {Freq: "MONTHLY", Interval: 3},
+		"semiannual": {Freq: "MONTHLY", Interval: 6},
+		"yearly":     {Freq: "YEARLY", Interval: 1},
+		"year":       {Freq: "YEARLY", Interval: 1},
+		"annual":     {Freq: "YEARLY", Interval: 1},
+		"biannual":   {Freq: "YEARLY", Interval: 2},
+		"biyearly":   {Freq: "YEARLY", Interval: 2},
+	}
+	// The units of the Taskwarrior durations, by the names they are given
+	// with. Minutes and seconds are too short for calendar recurrences.
+	recurUnits = map[string]string{
+		"h": "HOURLY", "hr": "HOURLY", "hrs": "HOURLY", "hour": "HOURLY", "hours": "HOURLY",
+		"d": "DAILY", "day": "DAILY", "days": "DAILY",
+		"w": "WEEKLY", "wk": "WEEKLY", "wks": "WEEKLY", "week": "WEEKLY", "weeks": "WEEKLY",
+		"m": "MONTHLY", "mo": "MONTHLY", "mos": "MONTHLY", "mth": "MONTHLY", "mths": "MONTHLY",
+		"mnth": "MONTHLY", "mnths": "MONTHLY", "month": "MONTHLY", "months": "MONTHLY",
+		"q": "QUARTERLY", "qtr": "QUARTERLY", "qtrs": "QUARTERLY", "quarter": "QUARTERLY", "quarters": "QUARTERLY",
+		"y": "YEARLY", "yr": "YEARLY", "yrs": "YEARLY", "year": "YEARLY", "years": "YEARLY",
+	}
+	recurCountRegex = regexp.MustCompile(`^(\d+)\s*([a-z]+)$`)
+	recurISORegex   = regexp.MustCompile(`^P(?:T(\d+)H|(\d+)([DWMY]))$`)
+	// Org-mode repeaters: +1w, ++1w and .+1w
+	orgRepeaterRegex = regexp.MustCompile(`^(?:\+\+|\.\+|\+)(\d+)([hdwmy])$`)
+)
+
+// ParseRecur parses a Taskwarrior recurrence period, e.g. "weekly", "2w",
+// "quarterly" or "P1M".
+func ParseRecur(recur string) (Recurrence, error) {
+	recur = strings.ToLower(strings.TrimSpace(recur))
+	if r, ok := recurPeriods[recur]; ok {
+		return r, nil
+	}
+
+	if m := recurCountRegex.FindStringSubmatch(recur); m != nil && recurUnits[m[2]] != "" {
+		n, _ := strconv.Atoi(m[1])
+		r := Recurrence{Freq: recurUnits[m[2]], Interval: n}
+		if r.Freq == "QUARTERLY" {
+			r.Freq, r.Interval = "MONTHLY", 3*n
+		}
+		return r, nil
+	}
+
+	if m := recurISORegex.FindStringSubmatch(strings.ToUpper(recur)); m != nil {
+		if m[1] != "" {
+			n, _ := strconv.Atoi(m[1])
+			return Recurrence{Freq: "HOURLY", Interval: n}, nil
+		}
+		n, _ := strconv.Atoi(m[2])
+		freq := map[string]string{"D": "DAILY", "W": "WEEKLY", "M": "MONTHLY", "Y": "YEARLY"}[m[3]]
+		return Recurrence{Freq: freq, Interval: n}, nil
+	}
+
+	return Recurrence{}, fmt.Errorf("unsupported recurrence '%s'", recur)
+}
+
+// ParseOrgRepeater parses the repeater of an Org-mode timestamp, e.g. "+1w".
+func ParseOrgRepeater(repeater string) (Recurrence, error) {
+	m := orgRepeaterRegex.FindStringSubmatch(repeater)
+	if m == nil {
+		return Recurrence{}, fmt.Errorf("unsupported repeater '%s'", repeater)
+	}
+	n, _ := strconv.Atoi(m[1])
+	freq := map[string]string{"h": "HOURLY", "d": "DAILY", "w": "WEEKLY", "m": "MONTHLY", "y": "YEARLY"}[m[2]]
+	return Recurrence{Freq: freq, Interval: n}, nil
+}
+
+// RRule returns the RRULE line of the recurrence, ending at until if set.
+func (r Recurrence) RRule(until time.Time) string {
+	rule := fmt.Sprintf("RRULE:FREQ=%s", r.Freq)
+	if r.Interval > 1 {
+		rule += fmt.Sprintf(";INTERVAL=%d", r.Interval)
+	}
+	if r.Weekdays {
+		rule += ";BYDAY=MO,TU,WE,TH,FR"
+	}
+	if !until.IsZero() {
+		rule += ";UNTIL=" + until.UTC().Format("20060102T150405Z")
+	}
+	return rule
+}
+
+// Occurrence returns the start of the i-th occurrence (0 based) of a
+// recurrence starting at start.
+func (r Recurrence) Occurrence(start time.Time, i int) time.Time {
+	if r.Weekdays {
+		t := start
+		for n := 0; n < i; {
+			t = t.AddDate(0, 0, 1)
+			if t.Weekday() != time.Saturday && t.Weekday() != time.Sunday {
+				n++
+			}
+		}
+		return t
+	}
+
+	n := i * r.Interval
+	switch r.Freq {
+	case "HOURLY":
+		return start.Add(time.Duration(n) * time.Hour)
+	case "DAILY":
+		return start.AddDate(0, 0, n)
+	case "WEEKLY":
+		return start.AddDate(0, 0, 7*n)
+	case "MONTHLY":
+		return start.AddDate(0, n, 0)
+	case "YEARLY":
+		return start.AddDate(n, 0, 0)
+	}
+	return start
+}
+
+// ExceptionDate returns the EXDATE line removing the occurrence starting at t.
+func ExceptionDate(t time.Time, allDay bool) string {
+	if allDay {
+		return "EXDATE;VALUE=DATE:" + t.In(time.Local).Format("20060102")
+	}
+	return "EXDATE:" + t.UTC().Format("20060102T150405Z")
+}
+
+// GroupRecurring folds the instances of the recurring templates found in
+// tasks into the templates: deleted instances become EXDATE exceptions and
+// completed ones are listed in the template CompletedInstances. Instances
+// whose template is not in tasks (e.g. excluded by the filter) are kept as
+// standalone tasks.
+func GroupRecurring(tasks []model.Task) []model.Task {
+	templates := make(map[string]int)
+	for i, task := range tasks {
+		if len(task.Recurrence) > 0 {
+			templates[task.ID] = i
+		}
+	}
+
+	var grouped []model.Task
+	for _, task := range tasks {
+		if _, ok := templates[task.Parent]; !ok || task.Parent == "" {
+			grouped = append(grouped, task)
+			continue
+		}
+		template := &tasks[templates[task.Parent]]
+		switch task.Status {
+		case "deleted":
+			template.Recurrence = appendUnique(template.Recurrence, ExceptionDate(task.Deadline, template.AllDay))
+		case "completed":
+			template.CompletedInstances = appendUniqueTime(template.CompletedInstances, task.Deadline)
+		}
+	}
+
+	// The templates were updated in place, after being copied to grouped
+	for i, task := range grouped {
+		if j, ok := templates[task.ID]; ok {
+			grouped[i] = tasks[j]
+			sort.Strings(grouped[i].Recurrence[1:])
+			sort.Slice(grouped[i].CompletedInstances, func(a, b int) bool {
+				return grouped[i].CompletedInstances[a].Before(grouped[i].CompletedInstances[b])
+			})
+		}
+	}
+	return grouped
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, item := range list {
+		if item == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func appendUniqueTime(list []time.Time, t time.Time) []time.Time {
+	for _, item := range list {
+		if item.Equal(t) {
+			return list
+		}
+	}
+	return append(list, t)
+}
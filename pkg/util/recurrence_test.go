@@ -0,0 +1,151 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+)
+
+func TestParseRecur(t *testing.T) {
+	tests := []struct {
+		recur   string
+		want    Recurrence
+		wantErr bool
+	}{
+		{recur: "weekly", want: Recurrence{Freq: "WEEKLY", Interval: 1}},
+		{recur: " Weekdays ", want: Recurrence{Freq: "DAILY", Interval: 1, Weekdays: true}},
+		{recur: "quarterly", want: Recurrence{Freq: "MONTHLY", Interval: 3}},
+		{recur: "2w", want: Recurrence{Freq: "WEEKLY", Interval: 2}},
+		{recur: "3 days", want: Recurrence{Freq: "DAILY", Interval: 3}},
+		{recur: "12h", want: Recurrence{Freq: "HOURLY", Interval: 12}},
+		{recur: "2m", want: Recurrence{Freq: "MONTHLY", Interval: 2}},
+		{recur: "2mo", want: Recurrence{Freq: "MONTHLY", Interval: 2}},
+		{recur: "6months", want: Recurrence{Freq: "MONTHLY", Interval: 6}},
+		{recur: "2q", want: Recurrence{Freq: "MONTHLY", Interval: 6}},
+		{recur: "1qtr", want: Recurrence{Freq: "MONTHLY", Interval: 3}},
+		{recur: "2yrs", want: Recurrence{Freq: "YEARLY", Interval: 2}},
+		{recur: "P1M", want: Recurrence{Freq: "MONTHLY", Interval: 1}},
+		{recur: "P2W", want: Recurrence{Freq: "WEEKLY", Interval: 2}},
+		{recur: "PT4H", want: Recurrence{Freq: "HOURLY", Interval: 4}},
+		{recur: "2min", wantErr: true},
+		{recur: "30s", wantErr: true},
+		{recur: "2wonders", wantErr: true},
+		{recur: "2dw", wantErr: true},
+		{recur: "sometimes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.recur, func(t *testing.T) {
+			got, err := ParseRecur(tt.recur)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOrgRepeater(t *testing.T) {
+	tests := []struct {
+		repeater string
+		want     Recurrence
+		wantErr  bool
+	}{
+		{repeater: "+1w", want: Recurrence{Freq: "WEEKLY", Interval: 1}},
+		{repeater: "++2d", want: Recurrence{Freq: "DAILY", Interval: 2}},
+		{repeater: ".+1m", want: Recurrence{Freq: "MONTHLY", Interval: 1}},
+		{repeater: "+3h", want: Recurrence{Freq: "HOURLY", Interval: 3}},
+		{repeater: "-2d", wantErr: true},
+		{repeater: "+1q", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repeater, func(t *testing.T) {
+			got, err := ParseOrgRepeater(tt.repeater)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRRule(t *testing.T) {
+	until := time.Date(2025, 12, 31, 23, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		r     Recurrence
+		until time.Time
+		want  string
+	}{
+		{name: "daily", r: Recurrence{Freq: "DAILY", Interval: 1}, want: "RRULE:FREQ=DAILY"},
+		{name: "interval", r: Recurrence{Freq: "WEEKLY", Interval: 2}, want: "RRULE:FREQ=WEEKLY;INTERVAL=2"},
+		{name: "weekdays", r: Recurrence{Freq: "DAILY", Interval: 1, Weekdays: true}, want: "RRULE:FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR"},
+		{name: "until", r: Recurrence{Freq: "MONTHLY", Interval: 1}, until: until, want: "RRULE:FREQ=MONTHLY;UNTIL=20251231T230000Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.RRule(tt.until); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOccurrence(t *testing.T) {
+	// A Friday
+	start := time.Date(2025, 1, 31, 9, 0, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		r    Recurrence
+		i    int
+		want time.Time
+	}{
+		{name: "first", r: Recurrence{Freq: "DAILY", Interval: 1}, i: 0, want: start},
+		{name: "hourly", r: Recurrence{Freq: "HOURLY", Interval: 6}, i: 2, want: start.Add(12 * time.Hour)},
+		{name: "weekly", r: Recurrence{Freq: "WEEKLY", Interval: 2}, i: 1, want: time.Date(2025, 2, 14, 9, 0, 0, 0, time.Local)},
+		{name: "weekdays skip the weekend", r: Recurrence{Freq: "DAILY", Interval: 1, Weekdays: true}, i: 1, want: time.Date(2025, 2, 3, 9, 0, 0, 0, time.Local)},
+		{name: "yearly", r: Recurrence{Freq: "YEARLY", Interval: 1}, i: 2, want: time.Date(2027, 1, 31, 9, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.Occurrence(start, tt.i); !got.Equal(tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupRecurring(t *testing.T) {
+	first := time.Date(2025, 3, 3, 9, 0, 0, 0, time.UTC)
+	second := first.AddDate(0, 0, 7)
+	third := second.AddDate(0, 0, 7)
+	tasks := []model.Task{
+		{ID: "template", Deadline: first, Recurrence: []string{"RRULE:FREQ=WEEKLY"}},
+		{ID: "done", Parent: "template", Status: "completed", Deadline: second},
+		{ID: "skipped", Parent: "template", Status: "deleted", Deadline: third},
+		{ID: "pending", Parent: "template", Status: "pending", Deadline: first},
+		{ID: "orphan", Parent: "filtered-out", Status: "pending", Deadline: first},
+		{ID: "single", Deadline: first},
+	}
+
+	grouped := GroupRecurring(tasks)
+	var ids []string
+	for _, task := range grouped {
+		ids = append(ids, task.ID)
+	}
+	if want := []string{"template", "orphan", "single"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got tasks %v, want %v", ids, want)
+	}
+	template := grouped[0]
+	if want := []string{"RRULE:FREQ=WEEKLY", "EXDATE:20250317T090000Z"}; !reflect.DeepEqual(template.Recurrence, want) {
+		t.Errorf("got recurrence %q, want %q", template.Recurrence, want)
+	}
+	if want := []time.Time{second}; !reflect.DeepEqual(template.CompletedInstances, want) {
+		t.Errorf("got completed instances %v, want %v", template.CompletedInstances, want)
+	}
+}
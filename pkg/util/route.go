@@ -0,0 +1,75 @@
+package util
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+)
+
+// Route sends the events of the tasks matching it to a calendar. A task
+// matches when its project matches the Project pattern and it has the Tag.
+// A pattern ending with ".*" matches the project itself too, e.g. "Work.*"
+// matches Work and all its sub-projects. Empty conditions match any task.
+type Route struct {
+	Project  string `mapstructure:"project"`
+	Tag      string `mapstructure:"tag"`
+	Calendar string `mapstructure:"calendar"`
+}
+
+// Validate checks that the route has a calendar, at least one condition and
+// a valid project pattern.
+func (r Route) Validate() error {
+	if r.Calendar == "" {
+		return fmt.Errorf("route has no calendar")
+	}
+	if r.Project == "" && r.Tag == "" {
+		return fmt.Errorf("route to calendar '%s' has neither project nor tag", r.Calendar)
+	}
+	if _, err := path.Match(r.Project, ""); err != nil {
+		return fmt.Errorf("invalid project pattern '%s': %w", r.Project, err)
+	}
+	return nil
+}
+
+// Match tells whether the task matches the route.
+func (r Route) Match(task *model.Task) bool {
+	if r.Project != "" && !matchProject(r.Project, task.Project) {
+		return false
+	}
+	if r.Tag != "" {
+		for _, tag := range task.Tags {
+			if tag == r.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// matchProject tells whether the project matches the pattern, or is the
+// parent project of the sub-projects matched by "<project>.*".
+func matchProject(pattern, project string) bool {
+	if ok, _ := path.Match(pattern, project); ok {
+		return true
+	}
+	parent, found := strings.CutSuffix(pattern, ".*")
+	if !found {
+		return false
+	}
+	ok, _ := path.Match(parent, project)
+	return ok
+}
+
+// RouteTask returns the calendar of the first route matching the task, or
+// defaultCalendar if none does.
+func RouteTask(routes []Route, task *model.Task, defaultCalendar string) string {
+	for _, route := range routes {
+		if route.Match(task) {
+			return route.Calendar
+		}
+	}
+	return defaultCalendar
+}
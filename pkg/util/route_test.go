@@ -0,0 +1,60 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+)
+
+func TestRouteTask(t *testing.T) {
+	routes := []Route{
+		{Project: "Work.*", Calendar: "Work"},
+		{Project: "Home", Tag: "family", Calendar: "Family"},
+		{Tag: "travel", Calendar: "Travel"},
+	}
+	tests := []struct {
+		name    string
+		project string
+		tags    []string
+		want    string
+	}{
+		{name: "project itself", project: "Work", want: "Work"},
+		{name: "sub-project", project: "Work.Reports", want: "Work"},
+		{name: "nested sub-project", project: "Work.Reports.Q3", want: "Work"},
+		{name: "project with the same prefix", project: "Workshop", want: "Tasks"},
+		{name: "project and tag", project: "Home", tags: []string{"chores", "family"}, want: "Family"},
+		{name: "project without the tag", project: "Home", tags: []string{"chores"}, want: "Tasks"},
+		{name: "tag only", tags: []string{"travel"}, want: "Travel"},
+		{name: "first route wins", project: "Work", tags: []string{"travel"}, want: "Work"},
+		{name: "no route", project: "Garden", want: "Tasks"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := &model.Task{Project: tt.project, Tags: tt.tags}
+			if got := RouteTask(routes, task, "Tasks"); got != tt.want {
+				t.Errorf("got calendar %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   Route
+		wantErr bool
+	}{
+		{name: "project", route: Route{Project: "Work.*", Calendar: "Work"}},
+		{name: "tag", route: Route{Tag: "family", Calendar: "Family"}},
+		{name: "no calendar", route: Route{Project: "Work"}, wantErr: true},
+		{name: "no condition", route: Route{Calendar: "Work"}, wantErr: true},
+		{name: "invalid pattern", route: Route{Project: "Work[", Calendar: "Work"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.route.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
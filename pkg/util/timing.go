@@ -0,0 +1,197 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+)
+
+const (
+	TIMING_DUE       = "due"
+	TIMING_SCHEDULED = "scheduled"
+	TIMING_WAIT      = "wait"
+	TIMING_UNTIL     = "until"
+	TIMING_DURATION  = "duration"
+
+	// DefaultDuration is the length of the events of tasks without a duration.
+	DefaultDuration = 30 * time.Minute
+)
+
+// TimingRules tell how the calendar event of a task is placed.
+type TimingRules struct {
+	// Start is the task date the event starts at: due (default), scheduled or wait.
+	Start string `mapstructure:"start"`
+	// End is the task date the event ends at: duration (default), due or until.
+	// With "duration" the event lasts the task Duration, or DefaultDuration.
+	End string `mapstructure:"end"`
+	// DurationUDA is the Taskwarrior UDA holding the task duration, e.g. "estimate".
+	DurationUDA string `mapstructure:"duration_uda"`
+	// DefaultDuration is used for the tasks without a duration.
+	DefaultDuration time.Duration `mapstructure:"default_duration"`
+}
+
+// Validate checks that the rules name known task dates.
+func (r TimingRules) Validate() error {
+	switch r.Start {
+	case "", TIMING_DUE, TIMING_SCHEDULED, TIMING_WAIT:
+	default:
+		return fmt.Errorf("invalid timing start '%s'. Please use '%s', '%s' or '%s'", r.Start, TIMING_DUE, TIMING_SCHEDULED, TIMING_WAIT)
+	}
+	switch r.End {
+	case "", TIMING_DURATION, TIMING_DUE, TIMING_UNTIL:
+	default:
+		return fmt.Errorf("invalid timing end '%s'. Please use '%s', '%s' or '%s'", r.End, TIMING_DURATION, TIMING_DUE, TIMING_UNTIL)
+	}
+	return nil
+}
+
+// Fields returns the task fields the start and the end of the task event are
+// computed from by ApplyTiming: TIMING_DUE, TIMING_SCHEDULED or TIMING_WAIT
+// for the start, TIMING_DUE, TIMING_UNTIL or TIMING_DURATION for the end.
+func (r TimingRules) Fields(task *model.Task) (start, end string) {
+	dates := taskDates(task)
+	start, end = r.Start, r.End
+	if dates[start].IsZero() {
+		start = TIMING_DUE
+	}
+	if !dates[end].After(dates[start]) {
+		end = TIMING_DURATION
+	}
+	return start, end
+}
+
+// SetTaskDate sets the task date named by a TIMING_* field.
+func SetTaskDate(task *model.Task, field string, t time.Time) {
+	switch field {
+	case TIMING_DUE:
+		task.Deadline = t
+	case TIMING_SCHEDULED:
+		task.Scheduled = t
+	case TIMING_WAIT:
+		task.Wait = t
+	case TIMING_UNTIL:
+		task.Until = t
+	}
+}
+
+func taskDates(task *model.Task) map[string]time.Time {
+	return map[string]time.Time{
+		TIMING_DUE:       task.Deadline,
+		TIMING_SCHEDULED: task.Scheduled,
+		TIMING_WAIT:      task.Wait,
+		TIMING_UNTIL:     task.Until,
+	}
+}
+
+// ApplyTiming sets the Start and End of the task according to the rules.
+// Dates missing from the task fall back to the default placement: the event
+// starts at the deadline and lasts the task (or the default) duration.
+func ApplyTiming(task *model.Task, rules TimingRules) {
+	dates := taskDates(task)
+
+	start := dates[rules.Start]
+	if start.IsZero() {
+		start = task.Deadline
+	}
+	if start.IsZero() {
+		return
+	}
+
+	end := dates[rules.End]
+	if !end.After(start) {
+		duration := task.Duration
+		if duration <= 0 {
+			duration = rules.DefaultDuration
+		}
+		if duration <= 0 {
+			duration = DefaultDuration
+		}
+		end = start.Add(duration)
+	}
+
+	task.Start = start
+	task.End = end
+	// An event starting at a time of day other than the date-only deadline
+	// is not an all-day event anymore
+	if task.AllDay && !start.Equal(task.Deadline) && !IsMidnight(start) {
+		task.AllDay = false
+	}
+}
+
+// TaskSpan returns the time span of the calendar event of the task. For
+// all-day tasks, the span goes from the local midnight of the start day to
+// the local midnight following the end, at least one day later.
+func TaskSpan(task *model.Task) (time.Time, time.Time) {
+	start, end := task.Start, task.End
+	if start.IsZero() || !end.After(start) {
+		start, end = task.Deadline, task.Deadline.Add(DefaultDuration)
+	}
+	if !task.AllDay {
+		return start, end
+	}
+
+	start = StartOfDay(start)
+	endDay := StartOfDay(end)
+	if end.After(endDay) {
+		endDay = endDay.AddDate(0, 0, 1)
+	}
+	if !endDay.After(start) {
+		endDay = start.AddDate(0, 0, 1)
+	}
+	return start, endDay
+}
+
+// IsMidnight reports whether t is at midnight, local time. Sources use it to
+// tell date-only deadlines.
+func IsMidnight(t time.Time) bool {
+	return !t.IsZero() && t.Equal(StartOfDay(t))
+}
+
+// StartOfDay returns the local midnight starting the day of t.
+func StartOfDay(t time.Time) time.Time {
+	t = t.In(time.Local)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+var isoDurationRegex = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// ParseDuration parses the durations found in task sources: ISO 8601 as
+// exported by Taskwarrior ("PT1H30M"), Org-mode efforts ("1:30") and Go
+// durations ("90m").
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+
+	if m := isoDurationRegex.FindStringSubmatch(s); m != nil && s != "P" && s != "PT" {
+		units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+		var d time.Duration
+		for i, unit := range units {
+			if m[i+1] == "" {
+				continue
+			}
+			n, err := strconv.Atoi(m[i+1])
+			if err != nil {
+				return 0, err
+			}
+			d += time.Duration(n) * unit
+		}
+		return d, nil
+	}
+
+	if hours, minutes, found := strings.Cut(s, ":"); found {
+		h, err := strconv.Atoi(hours)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration '%s': %w", s, err)
+		}
+		m, err := strconv.Atoi(minutes)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration '%s': %w", s, err)
+		}
+		return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+	}
+
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,188 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+)
+
+func TestTimingRulesValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   TimingRules
+		wantErr bool
+	}{
+		{name: "default", rules: TimingRules{}},
+		{name: "scheduled to due", rules: TimingRules{Start: TIMING_SCHEDULED, End: TIMING_DUE}},
+		{name: "wait to until", rules: TimingRules{Start: TIMING_WAIT, End: TIMING_UNTIL}},
+		{name: "invalid start", rules: TimingRules{Start: TIMING_UNTIL}, wantErr: true},
+		{name: "invalid end", rules: TimingRules{End: TIMING_WAIT}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rules.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyTiming(t *testing.T) {
+	day := time.Date(2025, 6, 2, 0, 0, 0, 0, time.Local)
+	due := day.Add(17 * time.Hour)
+	scheduled := day.Add(9 * time.Hour)
+	tests := []struct {
+		name       string
+		task       model.Task
+		rules      TimingRules
+		wantStart  time.Time
+		wantEnd    time.Time
+		wantAllDay bool
+		// the fields reported by Fields
+		start, end string
+	}{
+		{
+			name:      "default duration",
+			task:      model.Task{Deadline: due},
+			wantStart: due, wantEnd: due.Add(DefaultDuration),
+			start: TIMING_DUE, end: TIMING_DURATION,
+		},
+		{
+			name:      "task duration",
+			task:      model.Task{Deadline: due, Duration: time.Hour},
+			wantStart: due, wantEnd: due.Add(time.Hour),
+			start: TIMING_DUE, end: TIMING_DURATION,
+		},
+		{
+			name:      "configured default duration",
+			task:      model.Task{Deadline: due},
+			rules:     TimingRules{DefaultDuration: 15 * time.Minute},
+			wantStart: due, wantEnd: due.Add(15 * time.Minute),
+			start: TIMING_DUE, end: TIMING_DURATION,
+		},
+		{
+			name:      "scheduled to due",
+			task:      model.Task{Deadline: due, Scheduled: scheduled},
+			rules:     TimingRules{Start: TIMING_SCHEDULED, End: TIMING_DUE},
+			wantStart: scheduled, wantEnd: due,
+			start: TIMING_SCHEDULED, end: TIMING_DUE,
+		},
+		{
+			name:      "missing start falls back to due",
+			task:      model.Task{Deadline: due},
+			rules:     TimingRules{Start: TIMING_WAIT},
+			wantStart: due, wantEnd: due.Add(DefaultDuration),
+			start: TIMING_DUE, end: TIMING_DURATION,
+		},
+		{
+			name:      "end before start falls back to the duration",
+			task:      model.Task{Deadline: scheduled, Until: day, Duration: time.Hour},
+			rules:     TimingRules{End: TIMING_UNTIL},
+			wantStart: scheduled, wantEnd: scheduled.Add(time.Hour),
+			start: TIMING_DUE, end: TIMING_DURATION,
+		},
+		{
+			name:      "all-day deadline with a timed start",
+			task:      model.Task{Deadline: day, AllDay: true, Scheduled: scheduled},
+			rules:     TimingRules{Start: TIMING_SCHEDULED},
+			wantStart: scheduled, wantEnd: scheduled.Add(DefaultDuration),
+			start: TIMING_SCHEDULED, end: TIMING_DURATION,
+		},
+		{
+			name:      "all-day deadline with a date-only start",
+			task:      model.Task{Deadline: day, AllDay: true, Scheduled: day.AddDate(0, 0, -2)},
+			rules:     TimingRules{Start: TIMING_SCHEDULED},
+			wantStart: day.AddDate(0, 0, -2), wantEnd: day.AddDate(0, 0, -2).Add(DefaultDuration),
+			wantAllDay: true,
+			start:      TIMING_SCHEDULED, end: TIMING_DURATION,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := tt.task
+			ApplyTiming(&task, tt.rules)
+			if !task.Start.Equal(tt.wantStart) || !task.End.Equal(tt.wantEnd) || task.AllDay != tt.wantAllDay {
+				t.Errorf("got %s - %s (all-day %t), want %s - %s (all-day %t)",
+					task.Start, task.End, task.AllDay, tt.wantStart, tt.wantEnd, tt.wantAllDay)
+			}
+			if start, end := tt.rules.Fields(&task); start != tt.start || end != tt.end {
+				t.Errorf("got fields %s, %s, want %s, %s", start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestTaskSpan(t *testing.T) {
+	day := time.Date(2025, 6, 2, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		name      string
+		task      model.Task
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			name:      "timed",
+			task:      model.Task{Deadline: day.Add(9 * time.Hour), Start: day.Add(9 * time.Hour), End: day.Add(10 * time.Hour)},
+			wantStart: day.Add(9 * time.Hour), wantEnd: day.Add(10 * time.Hour),
+		},
+		{
+			name:      "timing not applied",
+			task:      model.Task{Deadline: day.Add(9 * time.Hour)},
+			wantStart: day.Add(9 * time.Hour), wantEnd: day.Add(9*time.Hour + DefaultDuration),
+		},
+		{
+			name:      "all-day",
+			task:      model.Task{Deadline: day, AllDay: true, Start: day, End: day.Add(DefaultDuration)},
+			wantStart: day, wantEnd: day.AddDate(0, 0, 1),
+		},
+		{
+			name:      "all-day over several days",
+			task:      model.Task{Deadline: day, AllDay: true, Start: day.AddDate(0, 0, -2), End: day.Add(9 * time.Hour)},
+			wantStart: day.AddDate(0, 0, -2), wantEnd: day.AddDate(0, 0, 1),
+		},
+		{
+			// As the end of all-day events, the end midnight is exclusive
+			name:      "all-day ending at midnight",
+			task:      model.Task{Deadline: day, AllDay: true, Start: day.AddDate(0, 0, -2), End: day},
+			wantStart: day.AddDate(0, 0, -2), wantEnd: day,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := TaskSpan(&tt.task)
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("got %s - %s, want %s - %s", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{s: "PT1H30M", want: 90 * time.Minute},
+		{s: "P1DT2H", want: 26 * time.Hour},
+		{s: "P1W", want: 7 * 24 * time.Hour},
+		{s: "1:30", want: 90 * time.Minute},
+		{s: "0:05", want: 5 * time.Minute},
+		{s: "45m", want: 45 * time.Minute},
+		{s: "PT", wantErr: true},
+		{s: "1:xx", wantErr: true},
+		{s: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseDuration(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,28 +1,60 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"os"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
 	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
-	"google.golang.org/api/calendar/v3"
 )
 
 const (
 	NEEDS_UPDATE_DESCRIPTION = "description"
 	NEEDS_UPDATE_STATUS      = "status"
 	NEEDS_UPDATE_DUE         = "due"
+	NEEDS_UPDATE_SCOPE       = "scope"
+	NEEDS_UPDATE_IDENTITY    = "identity"
+	NEEDS_UPDATE_RECURRENCE  = "recurrence"
+	NEEDS_UPDATE_COLOR       = "color"
+
+	// Private extended properties identifying the task behind an event.
+	// They are not visible to the calendar users, and can be queried with
+	// the privateExtendedProperty filter of the Events.List API.
+	PropertySource      = "taskwarrioragenda-source"
+	PropertyTaskID      = "taskwarrioragenda-id"
+	PropertySyncVersion = "taskwarrioragenda-version"
+	PropertyHash        = "taskwarrioragenda-hash"
+	// PropertyScope holds the scope of the task that created the event.
+	PropertyScope = "taskwarrioragenda-scope"
+
+	// SyncVersion is bumped whenever the event layout changes, so that
+	// events written by older versions are rewritten on the next sync.
+	SyncVersion = "2"
 )
 
+// TaskScope returns the scope of the tasks read from source with filter.
+func TaskScope(source, filter string) string {
+	return fmt.Sprintf("%s|%s", source, filter)
+}
+
 // EventNeedsUpdate returns true if the fields shared between a model.Task and a calendar.Event differ
-func EventNeedsUpdate(task *model.Task, event *calendar.Event) (bool, string, error) {
+func EventNeedsUpdate(task *model.Task, event *backend.Event) (bool, string, error) {
 	var eventIsCompleted bool
 	var eventIsDeleted bool
 	var cleanSummary string
 
+	// Events deleted from the calendar are restored, unless the task is
+	// deleted too: updating them makes them confirmed again
+	if event.Status == backend.StatusCancelled && task.Status != "deleted" {
+		return true, NEEDS_UPDATE_STATUS, nil
+	}
+
 	if strings.HasPrefix(event.Summary, "✅") {
 		eventIsCompleted = true
 		cleanSummary = strings.TrimSpace(strings.TrimPrefix(event.Summary, "✅"))
@@ -50,26 +82,51 @@ func EventNeedsUpdate(task *model.Task, event *calendar.Event) (bool, string, er
 		return true, NEEDS_UPDATE_DESCRIPTION, nil
 	}
 
-	// Check for due date mismatch
-	eventTime, err := time.Parse(time.RFC3339, event.Start.DateTime)
-	if err != nil {
-		return false, "", err
+	// Check for recurrence mismatch
+	if strings.Join(task.Recurrence, "\n") != strings.Join(event.Recurrence, "\n") {
+		return true, NEEDS_UPDATE_RECURRENCE, nil
 	}
 
-	if !eventTime.Equal(task.Deadline) {
+	// Check for due date (and duration) mismatch, all-day events included
+	if event.Start.IsZero() || event.End.IsZero() {
+		return false, "", fmt.Errorf("event has no start or end")
+	}
+	start, end := TaskSpan(task)
+	if event.AllDay != task.AllDay || !event.Start.Equal(start) || !event.End.Equal(end) {
 		log.Printf("task: %s, event: %s time needs update\n", task.Description, event.Summary)
 		return true, NEEDS_UPDATE_DUE, nil
 	}
 
+	if task.Color != event.Color {
+		return true, NEEDS_UPDATE_COLOR, nil
+	}
+
+	// The properties are checked last, as the hash changes with every field:
+	// the reason is the identity only when no field differs. Events created
+	// before the identity moved to the extended properties (or by older
+	// versions) are rewritten.
+	if event.Property(PropertyTaskID) != task.ID ||
+		event.Property(PropertySyncVersion) != SyncVersion {
+		return true, NEEDS_UPDATE_IDENTITY, nil
+	}
+	// Check for scope mismatch, e.g. the task moved to another file
+	if task.Scope != event.Property(PropertyScope) {
+		return true, NEEDS_UPDATE_SCOPE, nil
+	}
+	if event.Property(PropertyHash) != TaskHash(task) {
+		return true, NEEDS_UPDATE_IDENTITY, nil
+	}
+
 	return false, "", nil
 }
 
-func ConvertTaskToCalendarEvent(task *model.Task) (*calendar.Event, error) {
+func ConvertTaskToCalendarEvent(task *model.Task) (*backend.Event, error) {
 	if task == nil {
 		return nil, fmt.Errorf("could not convert nil Task")
 	}
 
-	if task.Deadline.IsZero() {
+	start, end := TaskSpan(task)
+	if start.IsZero() {
 		return nil, fmt.Errorf("could not sync Task without due date: task id %s\n", task.ID)
 	}
 
@@ -79,42 +136,127 @@ func ConvertTaskToCalendarEvent(task *model.Task) (*calendar.Event, error) {
 	switch task.Status {
 	case "pending":
 		eventSummary = task.Description
-		eventStatus = "confirmed"
+		eventStatus = backend.StatusConfirmed
 	case "completed":
 		eventSummary = fmt.Sprintf("✅ %s", task.Description)
-		eventStatus = "confirmed"
+		eventStatus = backend.StatusConfirmed
 	case "deleted":
 		eventSummary = fmt.Sprintf("❌ %s", task.Description)
-		eventStatus = "cancelled"
+		eventStatus = backend.StatusCancelled
 	default:
 		eventSummary = task.Description
-		eventStatus = "confirmed"
+		eventStatus = backend.StatusConfirmed
 	}
 
-	defaultDuration := 30 * time.Minute
-	eventDescription := fmt.Sprintf("Source: %s, ID: %s, Status: %s", task.Source, task.ID, task.Status)
-
-	event := &calendar.Event{
+	event := &backend.Event{
 		Summary: eventSummary,
 		Status:  eventStatus,
-		Start: &calendar.EventDateTime{
-			DateTime: task.Deadline.UTC().Format(time.RFC3339),
+		Properties: map[string]string{
+			PropertySource:      task.Source,
+			PropertyTaskID:      task.ID,
+			PropertySyncVersion: SyncVersion,
+			PropertyHash:        TaskHash(task),
 		},
-		End: &calendar.EventDateTime{
-			DateTime: task.Deadline.UTC().Add(defaultDuration).Format(time.RFC3339),
-		},
-		Description: eventDescription,
+		// The end of all-day events is exclusive
+		Start:  start,
+		End:    end,
+		AllDay: task.AllDay,
+		Color:  task.Color,
+	}
+	if task.Scope != "" {
+		event.Properties[PropertyScope] = task.Scope
+	}
+
+	if len(task.Recurrence) > 0 {
+		event.Recurrence = task.Recurrence
+		// Recurring events need the time zone the recurrence is expanded in
+		if !task.AllDay {
+			event.TimeZone = LocalTimeZone()
+		}
 	}
 
 	return event, nil
 }
 
-// GetTaskIDFromEventDescription parses the task ID from the event description.
+// LocalTimeZone returns the IANA name of the local time zone, or UTC when it
+// cannot be found.
+func LocalTimeZone() string {
+	if tz := os.Getenv("TZ"); tz != "" {
+		return strings.TrimPrefix(tz, ":")
+	}
+	if target, err := os.Readlink("/etc/localtime"); err == nil {
+		if _, name, found := strings.Cut(target, "zoneinfo/"); found {
+			return name
+		}
+	}
+	if name := time.Local.String(); name != "Local" {
+		return name
+	}
+	return "UTC"
+}
+
+// TaskFromEvent returns the task as it is represented by the calendar event,
+// so that changes made on the calendar can be compared with the original task.
+// Events removed from the calendar result in a deleted task.
+func TaskFromEvent(event *backend.Event) (model.Task, error) {
+	task := model.Task{
+		ID:          event.Property(PropertyTaskID),
+		Description: event.Summary,
+		Status:      "pending",
+		Source:      event.Property(PropertySource),
+		Scope:       event.Property(PropertyScope),
+	}
+
+	if strings.HasPrefix(event.Summary, "✅") {
+		task.Status = "completed"
+		task.Description = strings.TrimSpace(strings.TrimPrefix(event.Summary, "✅"))
+	} else if strings.HasPrefix(event.Summary, "❌") {
+		task.Status = "deleted"
+		task.Description = strings.TrimSpace(strings.TrimPrefix(event.Summary, "❌"))
+	}
+	if event.Status == backend.StatusCancelled {
+		task.Status = "deleted"
+	}
+
+	if !event.Start.IsZero() && !event.End.IsZero() {
+		task.Deadline = event.Start
+		task.Start = event.Start
+		task.End = event.End
+		task.AllDay = event.AllDay
+	}
+	task.Modified = event.Updated
+	return task, nil
+}
+
+// GetTaskIDFromEventDescription parses the task ID from the legacy event
+// description, "Source: <source>, ID: <id>, Status: <status>".
 func GetTaskIDFromEventDescription(description string) (string, bool) {
-	re := regexp.MustCompile(`ID: ([a-f0-9\-]+)`)
+	re := regexp.MustCompile(`ID: ([^,\s]+)`)
 	matches := re.FindStringSubmatch(description)
 	if len(matches) > 1 {
 		return matches[1], true
 	}
 	return "", false
-}
\ No newline at end of file
+}
+
+// TaskHash returns a digest of the task fields that end up in the calendar
+// event, so that unchanged tasks can be skipped without comparing events.
+func TaskHash(task *model.Task) string {
+	start, end := TaskSpan(task)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%t",
+		task.ID, task.Description, task.Deadline.UTC().Format(time.RFC3339), task.Status, task.Source, task.Scope,
+		start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339), task.AllDay)
+	// Not part of the format above, so that the hashes of the tasks without
+	// a color stay the same
+	if task.Color != "" {
+		fmt.Fprintf(h, "\x00color=%s", task.Color)
+	}
+	for _, rule := range task.Recurrence {
+		fmt.Fprintf(h, "\x00%s", rule)
+	}
+	for _, instance := range task.CompletedInstances {
+		fmt.Fprintf(h, "\x00%s", instance.UTC().Format(time.RFC3339))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
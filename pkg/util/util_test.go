@@ -0,0 +1,156 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/clobrano/TaskwarriorAgenda/pkg/backend"
+	"github.com/clobrano/TaskwarriorAgenda/pkg/model"
+)
+
+func TestEventNeedsUpdate(t *testing.T) {
+	due := time.Date(2025, 6, 2, 17, 0, 0, 0, time.Local)
+	task := model.Task{
+		ID: "task-1", Description: "Write report", Status: "pending", Deadline: due,
+		Source: "taskwarrior", Scope: TaskScope("taskwarrior", "+work"),
+	}
+	ApplyTiming(&task, TimingRules{})
+
+	tests := []struct {
+		name string
+		// task and event change the task and its up-to-date event
+		task    func(*model.Task)
+		event   func(*backend.Event)
+		want    string
+		wantErr bool
+	}{
+		{name: "up to date"},
+		{
+			name:  "deleted from the calendar",
+			event: func(e *backend.Event) { e.Status = backend.StatusCancelled },
+			want:  NEEDS_UPDATE_STATUS,
+		},
+		{
+			name: "completed",
+			task: func(t *model.Task) { t.Status = "completed" },
+			want: NEEDS_UPDATE_STATUS,
+		},
+		{
+			name:  "completed on the calendar only",
+			event: func(e *backend.Event) { e.Summary = "✅ " + e.Summary },
+			want:  NEEDS_UPDATE_STATUS,
+		},
+		{
+			name: "description and time",
+			task: func(t *model.Task) {
+				t.Description = "Write the report"
+				t.Start = t.Start.Add(time.Hour)
+			},
+			want: NEEDS_UPDATE_DESCRIPTION,
+		},
+		{
+			name: "recurrence",
+			task: func(t *model.Task) { t.Recurrence = []string{"RRULE:FREQ=WEEKLY"} },
+			want: NEEDS_UPDATE_RECURRENCE,
+		},
+		{
+			name:  "moved",
+			event: func(e *backend.Event) { e.Start, e.End = e.Start.Add(time.Hour), e.End.Add(time.Hour) },
+			want:  NEEDS_UPDATE_DUE,
+		},
+		{
+			name:  "resized",
+			event: func(e *backend.Event) { e.End = e.End.Add(time.Hour) },
+			want:  NEEDS_UPDATE_DUE,
+		},
+		{
+			name:  "all-day",
+			event: func(e *backend.Event) { e.AllDay = true },
+			want:  NEEDS_UPDATE_DUE,
+		},
+		{
+			name: "color",
+			task: func(t *model.Task) { t.Color = "5" },
+			want: NEEDS_UPDATE_COLOR,
+		},
+		{
+			name:  "legacy event without properties",
+			event: func(e *backend.Event) { e.Properties = nil },
+			want:  NEEDS_UPDATE_IDENTITY,
+		},
+		{
+			name:  "older sync version",
+			event: func(e *backend.Event) { e.Properties[PropertySyncVersion] = "1" },
+			want:  NEEDS_UPDATE_IDENTITY,
+		},
+		{
+			name: "scope",
+			task: func(t *model.Task) { t.Scope = TaskScope("taskwarrior", "+home") },
+			want: NEEDS_UPDATE_SCOPE,
+		},
+		{
+			name: "hash only",
+			task: func(t *model.Task) { t.Source = "notes.org" },
+			want: NEEDS_UPDATE_IDENTITY,
+		},
+		{
+			name:    "event without time",
+			event:   func(e *backend.Event) { e.Start = time.Time{} },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := ConvertTaskToCalendarEvent(&task)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changed := task
+			if tt.task != nil {
+				tt.task(&changed)
+			}
+			if tt.event != nil {
+				tt.event(event)
+			}
+
+			needsUpdate, reason, err := EventNeedsUpdate(&changed, event)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if needsUpdate != (tt.want != "") || reason != tt.want {
+				t.Errorf("got update %t with reason '%s', want reason '%s'", needsUpdate, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaskFromEvent(t *testing.T) {
+	start := time.Date(2025, 6, 2, 17, 0, 0, 0, time.Local)
+	tests := []struct {
+		name   string
+		event  backend.Event
+		status string
+		title  string
+	}{
+		{name: "pending", event: backend.Event{Summary: "Task"}, status: "pending", title: "Task"},
+		{name: "completed", event: backend.Event{Summary: "✅ Task"}, status: "completed", title: "Task"},
+		{name: "deleted", event: backend.Event{Summary: "❌ Task"}, status: "deleted", title: "Task"},
+		{name: "cancelled", event: backend.Event{Summary: "Task", Status: backend.StatusCancelled}, status: "deleted", title: "Task"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.event.Start, tt.event.End = start, start.Add(time.Hour)
+			tt.event.Properties = map[string]string{PropertyTaskID: "task-1"}
+			task, err := TaskFromEvent(&tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if task.ID != "task-1" || task.Status != tt.status || task.Description != tt.title {
+				t.Errorf("got task %s '%s' %s, want task-1 '%s' %s", task.ID, task.Description, task.Status, tt.title, tt.status)
+			}
+			if !task.Start.Equal(start) || !task.End.Equal(start.Add(time.Hour)) {
+				t.Errorf("got %s - %s, want the event time", task.Start, task.End)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package watch
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watcher reports the changes to a set of files and directories. Bursts of
+// events, like the ones caused by an editor saving a file, are reported once
+// no event has been seen for the debounce interval.
+type Watcher struct {
+	fsw      *fsnotify.Watcher
+	files    map[string]bool
+	dirs     map[string]bool
+	debounce time.Duration
+	changes  chan []string
+}
+
+// New starts watching the given files and directories. A directory is
+// changed when any file in it changes.
+func New(paths []string, debounce time.Duration) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create file watcher: %w", err)
+	}
+	w := &Watcher{
+		fsw:      fsw,
+		files:    make(map[string]bool),
+		dirs:     make(map[string]bool),
+		debounce: debounce,
+		changes:  make(chan []string),
+	}
+
+	watched := make(map[string]bool)
+	for _, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			fsw.Close()
+			return nil, fmt.Errorf("unable to watch %s: %w", path, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			fsw.Close()
+			return nil, fmt.Errorf("unable to watch %s: %w", path, err)
+		}
+
+		dir := path
+		if info.IsDir() {
+			w.dirs[path] = true
+		} else {
+			// Editors often replace a file instead of writing it, which
+			// would end a watch on the file itself
+			w.files[path] = true
+			dir = filepath.Dir(path)
+		}
+		if watched[dir] {
+			continue
+		}
+		if err := fsw.Add(dir); err != nil {
+			fsw.Close()
+			return nil, fmt.Errorf("unable to watch %s: %w", dir, err)
+		}
+		watched[dir] = true
+	}
+
+	go w.loop()
+	return w, nil
+}
+
+// Changes returns the channel receiving the paths changed by each burst of
+// events. It is closed when the watcher is closed.
+func (w *Watcher) Changes() <-chan []string {
+	return w.changes
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	return w.fsw.Close()
+}
+
+// loop collects the events until they settle down and sends the changed
+// paths. Events keep being collected while the receiver is busy.
+func (w *Watcher) loop() {
+	defer close(w.changes)
+
+	pending := make(map[string]bool)
+	timer := time.NewTimer(w.debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	var out chan []string
+	var batch []string
+	for {
+		select {
+		case event, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod || !w.relevant(event.Name) {
+				continue
+			}
+			pending[event.Name] = true
+			// Wait for the new burst to settle down before sending
+			out, batch = nil, nil
+			timer.Reset(w.debounce)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Error watching files: %v", err)
+		case <-timer.C:
+			batch = make([]string, 0, len(pending))
+			for path := range pending {
+				batch = append(batch, path)
+			}
+			sort.Strings(batch)
+			out = w.changes
+		case out <- batch:
+			pending = make(map[string]bool)
+			out, batch = nil, nil
+		}
+	}
+}
+
+// relevant tells whether the event on path is a change to a watched path.
+func (w *Watcher) relevant(path string) bool {
+	if w.files[path] {
+		return true
+	}
+	// SQLite journals come and go with every transaction, including the
+	// reads, while the database itself changes only on writes
+	if strings.HasSuffix(path, "-journal") {
+		return false
+	}
+	return w.dirs[filepath.Dir(path)]
+}